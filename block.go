@@ -0,0 +1,372 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// A block stream is a sequence of frames, each holding a block of data compressed independently of the others, so a
+// damaged frame loses only its own block:
+//
+//	magic     4 bytes  blockMagic
+//	flags     1 byte   blockFlagSequence
+//	sequence  4 bytes  big endian block number, only present if blockFlagSequence is set
+//	length    2 bytes  big endian length of the payload, at most maxBlockPayload
+//	check     2 bytes  big endian low 16 bits of the CRC-32 (IEEE) of flags through length
+//	payload   ...      raw heatshrink stream of the block
+//	checksum  4 bytes  big endian CRC-32 (IEEE) of flags through payload
+//
+// A reader resynchronizes after damage by searching for the next magic with a valid checksum. The header check lets it
+// reject a damaged length before waiting for that much input, which may never arrive on a live link.
+const (
+	blockFlagSequence byte = 1 << 0
+
+	blockTrailerSize = 4
+	// maxBlockPayload is the longest compressed block, with every byte of a MaxBlockSize block a 9 bit literal
+	maxBlockPayload = MaxBlockSize + MaxBlockSize/8
+
+	defaultBlockSize = 1 << 12
+	// MaxBlockSize is the largest BlockSize, for which the compressed block always fits the length field
+	MaxBlockSize = 1 << 15
+)
+
+var blockMagic = [4]byte{0xB1, 'H', 'S', 'B'}
+
+// BlockSize specifies the most uncompressed bytes NewBlockWriter puts in a block, from 1 to MaxBlockSize. Smaller blocks
+// lose less data to each damaged frame, but compress worse as each block starts with an empty window.
+// Recommended default: 4096
+func BlockSize(n int) func(*config) {
+	requested := n
+	if n < 1 {
+		n = 1
+	} else if n > MaxBlockSize {
+		n = MaxBlockSize
+	}
+	return func(c *config) {
+		if requested != n {
+			c.invalid("block size %d is outside 1 to %d", requested, MaxBlockSize)
+		}
+		c.blockSize = n
+	}
+}
+
+// BlockSequence makes NewBlockWriter number its blocks from 0, so readers can report exactly which blocks were lost.
+func BlockSequence() func(*config) {
+	return func(c *config) {
+		c.blockSequence = true
+	}
+}
+
+type blockWriter struct {
+	w       io.Writer
+	inner   *writer
+	payload sliceWriter
+
+	pending  int
+	sequence uint32
+	err      error
+}
+
+// NewBlockWriter creates a new WriteFlusher compressing the data written to it into a stream of independently decodable
+// blocks, for links which may drop or corrupt bytes. Each block is written to w as a frame with its length and a checksum
+// once BlockSize bytes have been written to it, or on Flush or Close. NewBlockReader decodes the stream, skipping damaged
+// frames.
+//
+// options modifies the default configuration values to use when compressing. Invalid option values are clamped to the
+// nearest valid value, as by NewWriter.
+//
+// It is the caller's responsibility to call Close on the WriteFlusher when done. The returned WriteFlusher also
+// implements Configurer, returning the settings used to compress each block.
+func NewBlockWriter(w io.Writer, options ...func(*config)) WriteFlusher {
+	bw := &blockWriter{w: w}
+	options = append([]func(*config){BlockSize(defaultBlockSize)}, options...)
+	bw.inner, _ = newWriter(&bw.payload, options...)
+	return bw
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	var done int
+	for len(p) > 0 {
+		n := bw.inner.blockSize - bw.pending
+		if n > len(p) {
+			n = len(p)
+		}
+		n, err := bw.inner.Write(p[:n])
+		done += n
+		bw.pending += n
+		if err != nil {
+			bw.err = err
+			return done, err
+		}
+		if bw.pending == bw.inner.blockSize {
+			err = bw.writeBlock()
+			if err != nil {
+				return done, err
+			}
+		}
+		p = p[n:]
+	}
+	return done, nil
+}
+
+// Flush ends the current block and writes it to the underlying io.Writer. The next block starts with an empty window,
+// so frequent flushes make the output larger.
+func (bw *blockWriter) Flush() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.pending == 0 {
+		return nil
+	}
+	return bw.writeBlock()
+}
+
+func (bw *blockWriter) Close() error {
+	return bw.Flush()
+}
+
+// Config returns the settings used to compress each block
+func (bw *blockWriter) Config() Config {
+	return bw.inner.Config()
+}
+
+// writeBlock ends the current block, writes its frame and starts the next
+func (bw *blockWriter) writeBlock() error {
+	err := bw.inner.Close()
+	if err != nil {
+		bw.err = err
+		return err
+	}
+	frame := make([]byte, len(blockMagic)+1, len(blockMagic)+9+len(bw.payload.buf)+blockTrailerSize)
+	copy(frame, blockMagic[:])
+	var field [4]byte
+	if bw.inner.blockSequence {
+		frame[len(blockMagic)] = blockFlagSequence
+		binary.BigEndian.PutUint32(field[:], bw.sequence)
+		frame = append(frame, field[:]...)
+	}
+	binary.BigEndian.PutUint16(field[:], uint16(len(bw.payload.buf)))
+	frame = append(frame, field[:2]...)
+	binary.BigEndian.PutUint16(field[:], uint16(crc32.ChecksumIEEE(frame[len(blockMagic):])))
+	frame = append(frame, field[:2]...)
+	frame = append(frame, bw.payload.buf...)
+	binary.BigEndian.PutUint32(field[:], crc32.ChecksumIEEE(frame[len(blockMagic):]))
+	frame = append(frame, field[:]...)
+	_, err = bw.w.Write(frame)
+	if err != nil {
+		bw.err = err
+		return err
+	}
+	bw.sequence++
+	bw.pending = 0
+	bw.payload.buf = bw.payload.buf[:0]
+	bw.inner.Reset(&bw.payload)
+	return nil
+}
+
+type blockReader struct {
+	r     io.Reader
+	inner *reader
+
+	// Input read from r and not yet consumed, starting at input byte offset, held in backing
+	buf     []byte
+	backing []byte
+	offset  int64
+	eof     bool
+
+	out      []byte
+	pending  []byte
+	read     int64
+	sequence uint32
+	err      error
+}
+
+// NewBlockReader creates a new io.Reader decompressing a stream written by NewBlockWriter from r. Damaged or missing frames
+// are skipped, and reported by returning a *BlockLossError before the data following them. Reading can continue after a
+// BlockLossError, so a loop which stops at the first error should check for it with errors.Is(err, ErrBlockLost).
+//
+// options modifies the default configuration values to use when decompressing, which must match those used to compress.
+// Invalid option values are clamped to the nearest valid value, as by NewReader. Blocks failing to decode with Strict are
+// treated as damaged. With MaxOutput, reading fails with ErrOutputLimitExceeded once the stream has more than that many
+// bytes in total.
+//
+// The returned io.Reader also implements Configurer, returning the settings the blocks are decoded with.
+func NewBlockReader(r io.Reader, options ...func(*config)) io.Reader {
+	br := &blockReader{r: r}
+	br.inner, _ = newReader(nil, options...)
+	return br
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.pending) == 0 {
+		if br.err != nil {
+			return 0, br.err
+		}
+		err := br.nextBlock()
+		if err != nil {
+			if _, ok := err.(*BlockLossError); ok {
+				return 0, err
+			}
+			br.err = err
+		}
+	}
+	n := copy(p, br.pending)
+	br.pending = br.pending[n:]
+	return n, nil
+}
+
+// Config returns the settings the blocks are decoded with
+func (br *blockReader) Config() Config {
+	return br.inner.Config()
+}
+
+// nextBlock decodes the next intact frame into pending, returning a *BlockLossError if anything was skipped to reach it,
+// or io.EOF at the end of the input.
+func (br *blockReader) nextBlock() error {
+	var start, skipped int64
+	skip := func(n int) {
+		if skipped == 0 {
+			start = br.offset
+		}
+		br.buf = br.buf[n:]
+		br.offset += int64(n)
+		skipped += int64(n)
+	}
+	lost := func(first uint32, count uint32) error {
+		return &BlockLossError{Offset: start, Skipped: skipped, First: first, Count: count}
+	}
+	for {
+		i := bytes.Index(br.buf, blockMagic[:])
+		if i < 0 {
+			// Keep the end of the input, which may be the start of the next magic
+			if n := len(br.buf) - len(blockMagic) + 1; n > 0 {
+				skip(n)
+			}
+			if br.eof {
+				skip(len(br.buf))
+				if skipped > 0 {
+					return lost(0, 0)
+				}
+				return io.EOF
+			}
+			err := br.fill(len(br.buf) + 1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if i > 0 {
+			skip(i)
+		}
+
+		headerSize := len(blockMagic) + 5
+		err := br.fill(len(blockMagic) + 1)
+		if err != nil {
+			return err
+		}
+		if len(br.buf) > len(blockMagic) && br.buf[len(blockMagic)]&blockFlagSequence != 0 {
+			headerSize += 4
+		}
+		err = br.fill(headerSize)
+		if err != nil {
+			return err
+		}
+		if len(br.buf) < headerSize || br.buf[len(blockMagic)]&^blockFlagSequence != 0 {
+			skip(1)
+			continue
+		}
+		header := br.buf[len(blockMagic) : headerSize-2]
+		length := int(binary.BigEndian.Uint16(header[len(header)-2:]))
+		if length > maxBlockPayload || uint16(crc32.ChecksumIEEE(header)) != binary.BigEndian.Uint16(br.buf[headerSize-2:]) {
+			skip(1)
+			continue
+		}
+		frameSize := headerSize + length + blockTrailerSize
+		err = br.fill(frameSize)
+		if err != nil {
+			return err
+		}
+		if len(br.buf) < frameSize {
+			skip(1)
+			continue
+		}
+		frame := br.buf[:frameSize]
+		if crc32.ChecksumIEEE(frame[len(blockMagic):frameSize-blockTrailerSize]) != binary.BigEndian.Uint32(frame[frameSize-blockTrailerSize:]) {
+			skip(1)
+			continue
+		}
+		br.inner.Reset(nil)
+		out, err := br.inner.decodeAll(br.out[:0], frame[headerSize:headerSize+length])
+		br.inner.buffer = nil
+		if err == ErrOutputLimitExceeded {
+			return err
+		} else if err != nil {
+			skip(1)
+			continue
+		}
+		br.out = out
+		if maxOutput := br.inner.maxOutput; maxOutput > 0 && br.read+int64(len(out)) > maxOutput {
+			return ErrOutputLimitExceeded
+		}
+		br.read += int64(len(out))
+		br.pending = out
+
+		hasSequence := frame[len(blockMagic)]&blockFlagSequence != 0
+		var sequence uint32
+		if hasSequence {
+			sequence = binary.BigEndian.Uint32(frame[len(blockMagic)+1:])
+		}
+		frameOffset := br.offset
+		br.buf = br.buf[frameSize:]
+		br.offset += int64(frameSize)
+
+		expected := br.sequence
+		if hasSequence {
+			br.sequence = sequence + 1
+			if sequence > expected {
+				if skipped == 0 {
+					// Whole frames went missing, so report where the gap was found
+					start = frameOffset
+				}
+				return lost(expected, sequence-expected)
+			}
+		}
+		if skipped > 0 {
+			return lost(0, 0)
+		}
+		return nil
+	}
+}
+
+// fill reads from r until buf holds at least n bytes or the input ends
+func (br *blockReader) fill(n int) error {
+	for len(br.buf) < n && !br.eof {
+		if cap(br.buf) < n {
+			// Move the input to the start of backing, growing it if needed
+			if len(br.backing) < n {
+				size := 2 * len(br.backing)
+				if size < n {
+					size = n
+				}
+				if size < 512 {
+					size = 512
+				}
+				br.backing = make([]byte, size)
+			}
+			br.buf = br.backing[:copy(br.backing, br.buf)]
+		}
+		count, err := br.r.Read(br.buf[len(br.buf):cap(br.buf)])
+		br.buf = br.buf[:len(br.buf)+count]
+		if err == io.EOF {
+			br.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// readBlocks reads r to the end, continuing after each BlockLossError
+func readBlocks(t *testing.T, r io.Reader) ([]byte, []*BlockLossError) {
+	var data []byte
+	var losses []*BlockLossError
+	buf := make([]byte, 100)
+	for {
+		n, err := r.Read(buf)
+		data = append(data, buf[:n]...)
+		var loss *BlockLossError
+		if errors.As(err, &loss) {
+			losses = append(losses, loss)
+		} else if err == io.EOF {
+			return data, losses
+		} else if err != nil {
+			t.Fatalf("Error decompressing: %v", err)
+		}
+	}
+}
+
+// writeBlocks compresses each block with NewBlockWriter, returning the frames written for each
+func writeBlocks(t *testing.T, blocks [][]byte, options ...func(*config)) [][]byte {
+	var encoded bytes.Buffer
+	w := NewBlockWriter(&encoded, options...)
+	var frames [][]byte
+	for _, b := range blocks {
+		w.Write(b)
+		err := w.Flush()
+		if err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+		frames = append(frames, append([]byte(nil), encoded.Bytes()...))
+		encoded.Reset()
+	}
+	err := w.Close()
+	if err != nil || encoded.Len() > 0 {
+		t.Fatalf("Close wrote %d bytes (%v)", encoded.Len(), err)
+	}
+	return frames
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	testdata := text(10000)
+	var encoded bytes.Buffer
+	w := NewBlockWriter(&encoded, Window(9), Lookahead(5), BlockSize(1000))
+	w.Write(testdata[:2500])
+	w.Write(testdata[2500:])
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Error compressing: %v", err)
+	}
+	if frames := bytes.Count(encoded.Bytes(), blockMagic[:]); frames != 10 {
+		t.Errorf("Expected 10 frames, got %d", frames)
+	}
+
+	r := NewBlockReader(iotest.OneByteReader(&encoded), Window(9), Lookahead(5))
+	if c := r.(Configurer).Config(); c.String() != "w9l5" {
+		t.Errorf("Expected w9l5, got %v", c)
+	}
+	decompressed, losses := readBlocks(t, r)
+	if len(losses) > 0 {
+		t.Errorf("Unexpected loss: %v", losses[0])
+	}
+	if !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Decompressed data differs from original")
+	}
+}
+
+func TestBlockDamage(t *testing.T) {
+	blocks := [][]byte{text(500), text(500), text(500), text(500), text(500), text(500)}
+	frames := writeBlocks(t, blocks, BlockSequence())
+
+	// Block 1 loses a byte, block 2 goes missing and block 4 has a byte changed
+	var damaged []byte
+	offset := len(frames[0])
+	damaged = append(damaged, frames[0]...)
+	damaged = append(damaged, frames[1][:20]...)
+	damaged = append(damaged, frames[1][21:]...)
+	damaged = append(damaged, frames[3]...)
+	frames[4][30] ^= 0x40
+	damaged = append(damaged, frames[4]...)
+	damaged = append(damaged, frames[5]...)
+
+	r := NewBlockReader(iotest.OneByteReader(bytes.NewReader(damaged)))
+	decompressed, losses := readBlocks(t, r)
+	expected := append(append(append([]byte(nil), blocks[0]...), blocks[3]...), blocks[5]...)
+	if !bytes.Equal(expected, decompressed) {
+		t.Errorf("Expected %d bytes from the intact blocks, got %d", len(expected), len(decompressed))
+	}
+	if len(losses) != 2 {
+		t.Fatalf("Expected 2 losses, got %v", losses)
+	}
+	if l := losses[0]; l.First != 1 || l.Count != 2 || l.Offset != int64(offset) || l.Skipped != int64(len(frames[1])-1) {
+		t.Errorf("Expected blocks 1 and 2 lost at %d, got %v", offset, l)
+	}
+	if l := losses[1]; l.First != 4 || l.Count != 1 || l.Skipped != int64(len(frames[4])) {
+		t.Errorf("Expected block 4 lost, got %v", l)
+	}
+	if !errors.Is(losses[0], ErrBlockLost) {
+		t.Errorf("Expected %v, got %v", ErrBlockLost, losses[0])
+	}
+
+	// A missing frame skips no bytes, and is found at the next frame
+	damaged = append(append([]byte(nil), frames[0]...), frames[2]...)
+	decompressed, losses = readBlocks(t, NewBlockReader(bytes.NewReader(damaged)))
+	if !bytes.Equal(append(append([]byte(nil), blocks[0]...), blocks[2]...), decompressed) {
+		t.Errorf("Decompressed data differs from the intact blocks")
+	}
+	if len(losses) != 1 || losses[0].First != 1 || losses[0].Count != 1 || losses[0].Offset != int64(offset) || losses[0].Skipped != 0 {
+		t.Errorf("Expected block 1 missing at %d, got %v", offset, losses)
+	}
+}
+
+func TestBlockDamagedLengthWithoutEOF(t *testing.T) {
+	blocks := [][]byte{text(500), text(500)}
+	frames := writeBlocks(t, blocks, BlockSequence())
+	// The high byte of block 0's length, which would make the reader wait for up to 64 KiB more input
+	frames[0][9] = 0xff
+
+	// The pipe is never closed, as on a live link
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(frames[0])
+		pw.Write(frames[1])
+	}()
+	r := NewBlockReader(pr)
+	done := make(chan error)
+	var decompressed []byte
+	var loss *BlockLossError
+	go func() {
+		buf := make([]byte, 100)
+		for len(decompressed) < len(blocks[1]) {
+			n, err := r.Read(buf)
+			decompressed = append(decompressed, buf[:n]...)
+			if errors.As(err, &loss) {
+				continue
+			} else if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Error decompressing: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Read blocked on a damaged length")
+	}
+	if !bytes.Equal(blocks[1], decompressed) {
+		t.Errorf("Decompressed data differs from block 1")
+	}
+	if loss == nil || loss.First != 0 || loss.Count != 1 || loss.Offset != 0 || loss.Skipped != int64(len(frames[0])) {
+		t.Errorf("Expected block 0 lost, got %v", loss)
+	}
+}
+
+func TestBlockDamageWithoutSequence(t *testing.T) {
+	blocks := [][]byte{text(300), text(300), text(300)}
+	frames := writeBlocks(t, blocks)
+
+	// Noise before the first frame, and the last frame cut short
+	damaged := append([]byte("\xb1HS noise"), frames[0]...)
+	damaged = append(damaged, frames[1]...)
+	damaged = append(damaged, frames[2][:len(frames[2])-1]...)
+
+	r := NewBlockReader(bytes.NewReader(damaged))
+	decompressed, losses := readBlocks(t, r)
+	if !bytes.Equal(append(append([]byte(nil), blocks[0]...), blocks[1]...), decompressed) {
+		t.Errorf("Decompressed data differs from the intact blocks")
+	}
+	if len(losses) != 2 {
+		t.Fatalf("Expected 2 losses, got %v", losses)
+	}
+	if l := losses[0]; l.Offset != 0 || l.Skipped != 9 || l.Count != 0 {
+		t.Errorf("Expected noise skipped, got %v", l)
+	}
+	if l := losses[1]; l.Offset != int64(9+len(frames[0])+len(frames[1])) || l.Skipped != int64(len(frames[2])-1) {
+		t.Errorf("Expected truncated frame skipped, got %v", l)
+	}
+}
@@ -1,8 +1,14 @@
 package goheatshrink
 
+import (
+	"fmt"
+	"strconv"
+)
+
 const (
 	defaultWindow    uint8 = 8
 	defaultLookahead uint8 = 4
+	defaultLevel     uint8 = GreedyLevel
 )
 
 // Valid values for Config settings
@@ -11,39 +17,246 @@ const (
 	MinWindow    uint8 = 4
 	// The maximum window to consider when searching for repeated patterns
 	MaxWindow    uint8 = 16
+	// The maximum window for ExtendedWindow
+	MaxExtendedWindow uint8 = 24
 	// The minimum number of bits to use in storing back-references
 	MinLookahead uint8 = 3
 )
 
+// Compression levels, trading encoding time for smaller output. All levels produce streams that can be decoded by
+// any heatshrink decoder with the same window and lookahead.
+const (
+	// GreedyLevel takes the longest match at each position
+	GreedyLevel uint8 = 1
+	// LazyLevel emits a literal instead of a match when the next position has a longer match
+	LazyLevel uint8 = 2
+	// OptimalLevel chooses the cheapest sequence of literals and back-references over each buffer of input
+	OptimalLevel uint8 = 3
+	// OfflineLevel chooses the cheapest sequence of literals and back-references over the whole input, which is held in
+	// memory until Flush or Close. Without MaxChainLength, the output is never larger than GreedyLevel's.
+	OfflineLevel uint8 = 4
+
+	// The minimum compression level
+	MinLevel = GreedyLevel
+	// The maximum compression level
+	MaxLevel = OfflineLevel
+)
+
 type config struct {
 	window    uint8
 	lookahead uint8
+	level     uint8
+
+	maxChainLength int
+	dictionary     []byte
+	strict         bool
+	maxOutput      int64
+
+	contentLength    int64
+	hasContentLength bool
+
+	blockSize     int
+	blockSequence bool
+	packetHistory bool
+
+	// The first invalid option value, reported by NewWriterOptions and NewReaderOptions
+	err error
+}
+
+// invalid records an invalid option value, unless one was already recorded
+func (c *config) invalid(format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf("%w: "+format, append([]interface{}{ErrConfig}, args...)...)
+	}
+}
+
+// check records settings which are invalid in combination, and returns the first invalid option value. A lookahead not
+// less than the window is left as given, so NewWriter and NewReader keep handling streams written with one.
+func (c *config) check() error {
+	if c.lookahead >= c.window {
+		c.invalid("lookahead %d is not less than window %d", c.lookahead, c.window)
+	}
+	return c.err
+}
+
+// Config holds the settings a stream was compressed with, which must be used again to decompress it.
+// Its text form, as in "w8l4", is suitable for storing alongside compressed data.
+type Config struct {
+	Window    uint8
+	Lookahead uint8
+}
+
+// Configurer is implemented by the readers and writers in this package, reporting the settings they use. A writer's
+// settings must be used again to decompress its output.
+type Configurer interface {
+	Config() Config
+}
+
+// Validate returns an error wrapping ErrConfig if the settings cannot be used. Windows up to MaxExtendedWindow are
+// allowed, as with ExtendedWindow.
+func (c Config) Validate() error {
+	cfg := &config{}
+	WithConfig(c)(cfg)
+	return cfg.check()
+}
+
+// String returns the text form of c
+func (c Config) String() string {
+	return "w" + strconv.Itoa(int(c.Window)) + "l" + strconv.Itoa(int(c.Lookahead))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (c Config) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the text form written by MarshalText for any settings a
+// reader or writer can report: a lookahead not less than the window is accepted, as by NewReader, although Validate
+// reports it.
+func (c *Config) UnmarshalText(text []byte) error {
+	var parsed Config
+	_, err := fmt.Sscanf(string(text), "w%dl%d", &parsed.Window, &parsed.Lookahead)
+	if err != nil || parsed.String() != string(text) {
+		return fmt.Errorf("%w: cannot parse %q", ErrConfig, text)
+	}
+	cfg := &config{}
+	WithConfig(parsed)(cfg)
+	if cfg.err != nil {
+		return cfg.err
+	}
+	*c = parsed
+	return nil
+}
+
+// WithConfig uses the window and lookahead of c, as set by ExtendedWindow and Lookahead
+func WithConfig(c Config) func(*config) {
+	window := ExtendedWindow(c.Window)
+	lookahead := Lookahead(c.Lookahead)
+	return func(cfg *config) {
+		window(cfg)
+		lookahead(cfg)
+	}
+}
+
+// Config returns the settings in c as a Config
+func (c *config) Config() Config {
+	return Config{Window: c.window, Lookahead: c.lookahead}
 }
 
 // Window specifies the Base 2 log of the size of the sliding window used to find repeating patterns. A larger value allows
 // searches a larger history of the data, potentially compressing more effectively, but will use more memory and processing time.
 // Recommended default: 8 (embedded systems), 10 (elsewhere)
 func Window(window uint8) func(*config) {
+	requested := window
 	if window < MinWindow {
 		window = MinWindow
 	} else if window > MaxWindow {
 		window = MaxWindow
 	}
 	return func(c *config) {
+		if requested != window {
+			c.invalid("window %d is outside %d to %d", requested, MinWindow, MaxWindow)
+		}
+		c.window = window
+	}
+}
+
+// ExtendedWindow is like Window, but allows windows up to MaxExtendedWindow for compressing large files on hosts with
+// plenty of memory. The encoder uses 2^(window+1) bytes of buffer plus four times as much for its index, and the decoder
+// 2^window bytes.
+// Streams with a window larger than MaxWindow cannot be decoded by the C heatshrink library.
+func ExtendedWindow(window uint8) func(*config) {
+	requested := window
+	if window < MinWindow {
+		window = MinWindow
+	} else if window > MaxExtendedWindow {
+		window = MaxExtendedWindow
+	}
+	return func(c *config) {
+		if requested != window {
+			c.invalid("window %d is outside %d to %d", requested, MinWindow, MaxExtendedWindow)
+		}
 		c.window = window
 	}
 }
 
 // Lookahead specifies the number of bits used for back-reference lengths. A larger value allows longer substitutions, but since
 // all back-references must use window + lookahead bits, larger window or lookahead can be counterproductive if most patterns are
-// small and/or local.
+// small and/or local. The lookahead should be less than the window, as the C heatshrink library requires. NewWriterOptions,
+// NewReaderOptions and DecodeAll report a larger one, while NewWriter, NewReader and EncodeAll use it as given.
 // Recommended default: 4
 func Lookahead(lookahead uint8) func(*config) {
+	requested := lookahead
 	if lookahead < MinLookahead {
 		lookahead = MinLookahead
 	}
 	return func(c *config) {
+		if requested != lookahead {
+			c.invalid("lookahead %d is less than %d", requested, MinLookahead)
+		}
 		c.lookahead = lookahead
 	}
 }
 
+// Level specifies how hard the encoder searches for the smallest encoding, from MinLevel to MaxLevel. Higher levels produce
+// smaller output at the cost of encoding time, but do not affect decoding.
+// Recommended default: GreedyLevel (embedded systems), OfflineLevel (preparing static data once for many decoders)
+func Level(level uint8) func(*config) {
+	requested := level
+	if level < MinLevel {
+		level = MinLevel
+	} else if level > MaxLevel {
+		level = MaxLevel
+	}
+	return func(c *config) {
+		if requested != level {
+			c.invalid("level %d is outside %d to %d", requested, MinLevel, MaxLevel)
+		}
+		c.level = level
+	}
+}
+
+// MaxChainLength limits the number of earlier positions compared against the input when searching for the longest match.
+// Without a limit, inputs where many positions in the window share their first two bytes (such as data made of a few
+// distinct byte values) take time proportional to the window size for every byte. A limit bounds the cost per byte, possibly missing the longest match.
+// Recommended default: 0 (no limit), or 16-256 with large windows
+func MaxChainLength(n int) func(*config) {
+	requested := n
+	if n < 0 {
+		n = 0
+	}
+	return func(c *config) {
+		if requested != n {
+			c.invalid("max chain length %d is negative", requested)
+		}
+		c.maxChainLength = n
+	}
+}
+
+// Strict makes readers reject input a correct encoder could not have produced: back-references reaching before the first
+// byte of the stream (or its Dictionary), and non-zero padding bits at the end of the stream. This detects most corruption
+// without a checksum. Writers given Strict never produce back-references before the first byte.
+// Other encoders, including the C heatshrink library, may refer to the zero-filled window before the first byte when the
+// input starts with zeros, so their output can fail strict decoding.
+func Strict() func(*config) {
+	return func(c *config) {
+		c.strict = true
+	}
+}
+
+// MaxOutput limits readers and DecodeAll to n bytes of decompressed data. Reading fails with ErrOutputLimitExceeded once
+// the stream is found to have more, without decompressing the rest. This protects against small inputs which expand
+// enormously.
+// Recommended default: 0 (no limit), or the largest expected size when decompressing untrusted input
+func MaxOutput(n int64) func(*config) {
+	requested := n
+	if n < 0 {
+		n = 0
+	}
+	return func(c *config) {
+		if requested != n {
+			c.invalid("max output %d is negative", requested)
+		}
+		c.maxOutput = n
+	}
+}
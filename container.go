@@ -0,0 +1,300 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The container wraps a raw heatshrink stream with the settings needed to decode it:
+//
+//	magic         4 bytes  "HSHK"
+//	version       1 byte   containerVersion
+//	window        1 byte
+//	lookahead     1 byte
+//	flags         1 byte   containerFlagContentLength | containerFlagDictionary
+//	length        uvarint  uncompressed length, only present if containerFlagContentLength is set
+//	dictionary    4 bytes  big endian CRC-32 (IEEE) of the dictionary used, only present if containerFlagDictionary is set
+//	payload       ...      raw heatshrink stream
+//	checksum      4 bytes  big endian CRC-32 (IEEE) of the uncompressed data
+const (
+	containerVersion     byte = 1
+	containerHeaderSize       = 8
+	containerTrailerSize      = 4
+
+	containerFlagContentLength byte = 1 << 0
+	containerFlagDictionary    byte = 1 << 1
+)
+
+var containerMagic = [4]byte{'H', 'S', 'H', 'K'}
+
+// ContentLength records the uncompressed length of the data in the header written by NewContainerWriter.
+// Close fails with ErrContentLength if a different number of bytes was written.
+func ContentLength(n int64) func(*config) {
+	return func(c *config) {
+		c.contentLength = n
+		c.hasContentLength = true
+	}
+}
+
+type containerWriter struct {
+	w     io.Writer
+	inner *writer
+	crc   hash.Hash32
+
+	written     int64
+	wroteHeader bool
+	err         error
+}
+
+// NewContainerWriter creates a new io.WriteCloser. Writes to the returned io.WriteCloser are compressed and written to w,
+// preceded by a header recording the window and lookahead used and followed by a checksum of the uncompressed data, so the
+// output can be decoded by NewContainerReader without knowing the configuration.
+//
+// options modifies the default configuration values to use when compressing. Invalid option values are clamped to the
+// nearest valid value, as by NewWriter, but a lookahead not less than the window cannot be recorded in the header:
+// Write and Close then fail with an error wrapping ErrConfig, without writing anything.
+//
+// It is the caller's responsibility to call Close on the io.WriteCloser when done. The checksum is not written until Close.
+// The returned io.WriteCloser also implements Configurer, returning the settings recorded in the header.
+func NewContainerWriter(w io.Writer, options ...func(*config)) io.WriteCloser {
+	inner, _ := newWriter(w, options...)
+	return &containerWriter{
+		w:     w,
+		inner: inner,
+		crc:   crc32.NewIEEE(),
+		err:   inner.Config().Validate(),
+	}
+}
+
+func (cw *containerWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	err := cw.writeHeader()
+	if err != nil {
+		return 0, err
+	}
+	n, err := cw.inner.Write(p)
+	cw.crc.Write(p[:n])
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *containerWriter) Close() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	err := cw.writeHeader()
+	if err != nil {
+		return err
+	}
+	err = cw.inner.Close()
+	if err != nil {
+		return err
+	}
+	if cw.inner.hasContentLength && cw.inner.contentLength != cw.written {
+		return ErrContentLength
+	}
+	var trailer [containerTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[:], cw.crc.Sum32())
+	_, err = cw.w.Write(trailer[:])
+	return err
+}
+
+// Config returns the settings recorded in the header
+func (cw *containerWriter) Config() Config {
+	return cw.inner.Config()
+}
+
+func (cw *containerWriter) writeHeader() error {
+	if cw.wroteHeader {
+		return nil
+	}
+	header := make([]byte, containerHeaderSize, containerHeaderSize+binary.MaxVarintLen64+4)
+	copy(header, containerMagic[:])
+	header[4] = containerVersion
+	header[5] = cw.inner.window
+	header[6] = cw.inner.lookahead
+	if cw.inner.hasContentLength {
+		header[7] |= containerFlagContentLength
+		var length [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(length[:], uint64(cw.inner.contentLength))
+		header = append(header, length[:n]...)
+	}
+	if d := cw.inner.dictionaryWindow(); len(d) > 0 {
+		header[7] |= containerFlagDictionary
+		var id [4]byte
+		binary.BigEndian.PutUint32(id[:], crc32.ChecksumIEEE(d))
+		header = append(header, id[:]...)
+	}
+	_, err := cw.w.Write(header)
+	if err != nil {
+		return err
+	}
+	cw.wroteHeader = true
+	return nil
+}
+
+type containerReader struct {
+	inner   *reader
+	trailer *trailerReader
+	crc     hash.Hash32
+
+	headerSize       int64
+	read             int64
+	contentLength    int64
+	hasContentLength bool
+}
+
+// NewContainerReader creates a new io.Reader decompressing a stream written by NewContainerWriter. The window and lookahead
+// are taken from the stream header, and the checksum (and length, if recorded) are verified when the end of the stream is reached.
+//
+// If r does not start with a container header it is decoded as a raw heatshrink stream, as by NewReader.
+// Either way, the returned io.Reader implements Configurer, returning the settings the stream is decoded with.
+//
+// options modifies the default configuration values to use when decompressing a raw stream, and an error wrapping
+// ErrConfig is returned if they are invalid. Settings recorded in the header replace those in options, while others such
+// as Strict and MaxOutput apply to either. If the stream was compressed with a Dictionary, the same Dictionary must be
+// given in options.
+func NewContainerReader(r io.Reader, options ...func(*config)) (io.Reader, error) {
+	var header [containerHeaderSize]byte
+	n, err := io.ReadFull(r, header[:len(containerMagic)])
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.Equal(header[:n], containerMagic[:])) {
+		return NewReaderOptions(io.MultiReader(bytes.NewReader(header[:n]), r), options...)
+	} else if err != nil {
+		return nil, err
+	}
+	n, err = io.ReadFull(r, header[len(containerMagic):])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, truncatedHeader(int64(len(containerMagic) + n))
+		}
+		return nil, err
+	}
+	version, window, lookahead, flags := header[4], header[5], header[6], header[7]
+	if version != containerVersion || window < MinWindow || window > MaxExtendedWindow || lookahead < MinLookahead || lookahead >= window || flags&^(containerFlagContentLength|containerFlagDictionary) != 0 {
+		return nil, ErrHeader
+	}
+	cr := &containerReader{
+		crc:        crc32.NewIEEE(),
+		headerSize: containerHeaderSize,
+	}
+	if flags&containerFlagContentLength != 0 {
+		br := &byteReader{r: r}
+		length, err := binary.ReadUvarint(br)
+		cr.headerSize += br.n
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, truncatedHeader(cr.headerSize)
+			}
+			return nil, ErrHeader
+		}
+		cr.contentLength = int64(length)
+		cr.hasContentLength = true
+	}
+	var dictionary []byte
+	if flags&containerFlagDictionary != 0 {
+		var id [4]byte
+		n, err = io.ReadFull(r, id[:])
+		cr.headerSize += int64(n)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, truncatedHeader(cr.headerSize)
+			}
+			return nil, err
+		}
+		c := &config{}
+		for _, option := range options {
+			option(c)
+		}
+		c.window = window
+		dictionary = c.dictionaryWindow()
+		if len(dictionary) == 0 || crc32.ChecksumIEEE(dictionary) != binary.BigEndian.Uint32(id[:]) {
+			return nil, ErrDictionary
+		}
+	}
+	cr.trailer = &trailerReader{r: r}
+	// Settings from the header replace those in options
+	options = append(options[:len(options):len(options)], ExtendedWindow(window), Lookahead(lookahead), Dictionary(dictionary))
+	cr.inner, _ = newReader(cr.trailer, options...)
+	return cr, nil
+}
+
+// truncatedHeader reports a container ending after offset bytes, part way through its header
+func truncatedHeader(offset int64) error {
+	return &CorruptInputError{Offset: offset, State: "Header", Err: ErrTruncated}
+}
+
+// Config returns the settings recorded in the header
+func (cr *containerReader) Config() Config {
+	return cr.inner.Config()
+}
+
+func (cr *containerReader) Read(p []byte) (int, error) {
+	n, err := cr.inner.Read(p)
+	cr.crc.Write(p[:n])
+	cr.read += int64(n)
+	if cr.hasContentLength && cr.read > cr.contentLength {
+		return n, ErrContentLength
+	}
+	if err == io.EOF {
+		if cr.trailer.n < containerTrailerSize {
+			return n, &CorruptInputError{
+				Offset: cr.headerSize + cr.inner.inputOffset + int64(cr.trailer.n),
+				State:  "Trailer",
+				Output: cr.read,
+				Err:    ErrTruncated,
+			}
+		}
+		if binary.BigEndian.Uint32(cr.trailer.buf[:]) != cr.crc.Sum32() {
+			return n, ErrChecksum
+		}
+		if cr.hasContentLength && cr.read != cr.contentLength {
+			return n, ErrContentLength
+		}
+	}
+	return n, err
+}
+
+// trailerReader passes through everything read from r except the final containerTrailerSize bytes, which are held back in buf.
+type trailerReader struct {
+	r   io.Reader
+	buf [2 * containerTrailerSize]byte
+	n   int
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	if len(p) <= containerTrailerSize {
+		count, err := t.r.Read(t.buf[t.n : t.n+len(p)])
+		return t.holdBack(p, t.buf[:t.n+count]), err
+	}
+	copy(p, t.buf[:t.n])
+	count, err := t.r.Read(p[t.n:])
+	return t.holdBack(p, p[:t.n+count]), err
+}
+
+// holdBack copies all but the last containerTrailerSize bytes of data to p, and keeps the rest in buf.
+func (t *trailerReader) holdBack(p []byte, data []byte) int {
+	n := len(data) - containerTrailerSize
+	if n < 0 {
+		n = 0
+	}
+	copy(p, data[:n])
+	t.n = copy(t.buf[:], data[n:])
+	return n
+}
+
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+	n   int64
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	n, err := io.ReadFull(b.r, b.buf[:])
+	b.n += int64(n)
+	return b.buf[0], err
+}
@@ -0,0 +1,182 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestContainerRoundTrip(t *testing.T) {
+	testdata := random(1 << 12)
+	testdata = append(testdata, testdata...)
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded, Window(10), Lookahead(5), ContentLength(int64(len(testdata))))
+	_, err := w.Write(testdata)
+	if err != nil {
+		t.Fatalf("Error compressing: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	r, err := NewContainerReader(&encoded)
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	if c := r.(Configurer).Config(); c.String() != "w10l5" {
+		t.Errorf("Expected w10l5, got %v", c)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	if !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Decompressed data differs from original")
+	}
+}
+
+func TestContainerLookaheadNotLessThanWindow(t *testing.T) {
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded, Window(8), Lookahead(8))
+	_, err := w.Write([]byte("abcabcabc"))
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected %v from Write, got %v", ErrConfig, err)
+	}
+	err = w.Close()
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected %v from Close, got %v", ErrConfig, err)
+	}
+	if encoded.Len() != 0 {
+		t.Errorf("Expected nothing written, got %d bytes", encoded.Len())
+	}
+
+	// The same settings round trip without a container
+	testdata := text(1 << 10)
+	compressed, err := compress(testdata, 8, 8)
+	if err != nil {
+		t.Fatalf("Error compressing: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(NewReader(bytes.NewReader(compressed), Window(8), Lookahead(8)))
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	if !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Decompressed data differs from original")
+	}
+}
+
+func TestContainerRawFallback(t *testing.T) {
+	testdata := random(1 << 10)
+	compressed, err := compress(testdata, 9, 5)
+	if err != nil {
+		t.Fatalf("Error compressing: %v", err)
+	}
+	r, err := NewContainerReader(bytes.NewReader(compressed), Window(9), Lookahead(5))
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	if !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Decompressed data differs from original")
+	}
+}
+
+func TestContainerCorruption(t *testing.T) {
+	testdata := []byte("abcabcdabcdeabcdefabcdefgabcdefgh")
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded)
+	w.Write(testdata)
+	w.Close()
+
+	corrupted := append([]byte(nil), encoded.Bytes()...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	r, err := NewContainerReader(bytes.NewReader(corrupted))
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrChecksum {
+		t.Errorf("Expected %v, got %v", ErrChecksum, err)
+	}
+
+	corrupted = append([]byte(nil), encoded.Bytes()...)
+	corrupted[5] = MaxExtendedWindow + 1
+	_, err = NewContainerReader(bytes.NewReader(corrupted))
+	if err != ErrHeader {
+		t.Errorf("Expected %v, got %v", ErrHeader, err)
+	}
+}
+
+func TestContainerTruncated(t *testing.T) {
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded, ContentLength(0))
+	w.Close()
+	for cut := len(containerMagic) + 1; cut < encoded.Len(); cut++ {
+		r, err := NewContainerReader(bytes.NewReader(encoded.Bytes()[:cut]))
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		var corrupt *CorruptInputError
+		if !errors.As(err, &corrupt) || !errors.Is(err, ErrTruncated) || corrupt.Offset != int64(cut) {
+			t.Errorf("Cut at %d: expected truncated CorruptInputError at %d, got %v", cut, cut, err)
+		}
+	}
+}
+
+func TestContainerContentLengthMismatch(t *testing.T) {
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded, ContentLength(10))
+	w.Write([]byte("abc"))
+	err := w.Close()
+	if err != ErrContentLength {
+		t.Errorf("Expected %v, got %v", ErrContentLength, err)
+	}
+}
+
+func TestContainerMaxOutput(t *testing.T) {
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded, Window(10))
+	w.Write(make([]byte, 1<<16))
+	w.Close()
+	r, err := NewContainerReader(&encoded, MaxOutput(1<<10))
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrOutputLimitExceeded {
+		t.Errorf("Expected %v, got %v", ErrOutputLimitExceeded, err)
+	}
+}
+
+func TestContainerDictionary(t *testing.T) {
+	dictionary := []byte("abcdefgh")
+	var encoded bytes.Buffer
+	w := NewContainerWriter(&encoded, Dictionary(dictionary))
+	w.Write([]byte("abcdefghabcdefgh"))
+	w.Close()
+
+	_, err := NewContainerReader(bytes.NewReader(encoded.Bytes()))
+	if err != ErrDictionary {
+		t.Errorf("Expected %v, got %v", ErrDictionary, err)
+	}
+	_, err = NewContainerReader(bytes.NewReader(encoded.Bytes()), Dictionary([]byte("hgfedcba")))
+	if err != ErrDictionary {
+		t.Errorf("Expected %v, got %v", ErrDictionary, err)
+	}
+	r, err := NewContainerReader(bytes.NewReader(encoded.Bytes()), Dictionary(dictionary))
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	if string(decompressed) != "abcdefghabcdefgh" {
+		t.Errorf("Expected %q decompressed %q", "abcdefghabcdefgh", decompressed)
+	}
+}
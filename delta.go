@@ -0,0 +1,172 @@
+package goheatshrink
+
+import (
+	"io"
+	"sort"
+)
+
+// A delta stream encodes new data as changes to an old image, such as the firmware a device is currently running.
+// Each back-reference carries one extra bit after the tag bit selecting where it copies from:
+//
+//	0  the sliding window, with a window bit index field exactly as in a plain stream
+//	1  the old image, with a deltaOffsetBits index field holding a signed offset from the reference cursor
+//
+// The offset is stored plus 2^(deltaOffsetBits-1). The reference cursor starts at 0 and moves to the end of each copy from
+// the old image, so after data is inserted the rest of the image is found at the cursor again, and only removed data has
+// to be skipped with the offset. Applying a delta needs the 2^window byte sliding window plus random access to the old
+// image, which can stay in flash.
+const deltaOffsetBits = 16
+
+// NewDeltaWriter creates a new WriteResetter compressing the data written to it as a delta against old, writing the result
+// to w. The stream must be decompressed by NewDeltaReader with the same old image and options.
+//
+// options modifies the default configuration values to use when compressing. Delta streams are always encoded with the
+// greedy parse, so Level has no effect. Unchanged parts of the image are copied at most 2^lookahead bytes at a time, so a
+// long Lookahead gives much smaller deltas.
+func NewDeltaWriter(w io.Writer, old []byte, options ...func(*config)) WriteResetter {
+	hw := NewWriter(w, options...).(*writer)
+	hw.level = GreedyLevel
+	hw.setReference(old)
+	return hw
+}
+
+// NewDeltaReader creates a new ReadResetter decompressing a stream written by NewDeltaWriter from r, reading the old image
+// the stream was compressed against from old.
+//
+// options modifies the default configuration values to use when decompressing
+func NewDeltaReader(r io.Reader, old io.ReaderAt, options ...func(*config)) ReadResetter {
+	hr := NewReader(r, options...).(*reader)
+	hr.reference = old
+	return hr
+}
+
+// setReference indexes every position of old by its first two bytes, so the positions near the reference cursor starting
+// with the same two bytes as the input can be found with a binary search.
+func (w *writer) setReference(old []byte) {
+	w.reference = old
+	w.referenceBuckets = make([]int32, 1<<16+1)
+	if len(old) < 2 {
+		w.referencePositions = nil
+		return
+	}
+	for i := 0; i < len(old)-1; i++ {
+		w.referenceBuckets[referenceKey(old[i:])+1]++
+	}
+	for k := 1; k < len(w.referenceBuckets); k++ {
+		w.referenceBuckets[k] += w.referenceBuckets[k-1]
+	}
+	w.referencePositions = make([]int32, len(old)-1)
+	next := append([]int32(nil), w.referenceBuckets[:1<<16]...)
+	for i := 0; i < len(old)-1; i++ {
+		k := referenceKey(old[i:])
+		w.referencePositions[next[k]] = int32(i)
+		next[k]++
+	}
+}
+
+func referenceKey(b []byte) int {
+	return int(b[0])<<8 | int(b[1])
+}
+
+// indexBits returns the width of the index field of the current back-reference
+func (r *reader) indexBits() uint8 {
+	if r.fromReference {
+		return deltaOffsetBits
+	}
+	return r.window
+}
+
+// deltaMatch returns the longer of the longest match for the input at msi in the window and in the old image
+func (w *writer) deltaMatch(msi int) (int, int) {
+	matchPos, matchLength := w.longestMatchAt(msi)
+	w.matchFromReference = false
+	refPos, refLength := w.referenceMatchAt(msi)
+	if refLength > matchLength {
+		w.matchFromReference = true
+		return refPos, refLength
+	}
+	return matchPos, matchLength
+}
+
+// referenceMatchAt returns the encoded index field and length of the longest match for the input at msi in the part of
+// the old image the offset field can reach from the reference cursor. The candidates closest to the cursor are tried first.
+func (w *writer) referenceMatchAt(msi int) (int, int) {
+	lookaheadLength := w.maxMatchLength()
+	end := w.getInputBufferSize() + msi
+	maxPossible := lookaheadLength
+	if w.inputSize-msi < lookaheadLength {
+		maxPossible = w.inputSize - msi
+	}
+	if maxPossible < 2 || len(w.referencePositions) == 0 {
+		return matchNotFound, 0
+	}
+	half := 1 << (deltaOffsetBits - 1)
+	k := referenceKey(w.buffer[end:])
+	bucket := w.referencePositions[w.referenceBuckets[k]:w.referenceBuckets[k+1]]
+	lo := w.referenceCursor - half
+	hi := w.referenceCursor + half
+	first := sort.Search(len(bucket), func(i int) bool { return int(bucket[i]) >= lo })
+	mid := sort.Search(len(bucket), func(i int) bool { return int(bucket[i]) >= w.referenceCursor })
+
+	needle := w.buffer[end : end+maxPossible]
+	matchLength := 0
+	matchAddress := matchNotFound
+	chain := 0
+	try := func(pos int) bool {
+		if w.maxChainLength > 0 && chain == w.maxChainLength {
+			return false
+		}
+		chain++
+		candidate := w.reference[pos:]
+		l := 0
+		for l < len(needle) && l < len(candidate) && candidate[l] == needle[l] {
+			l++
+		}
+		if l > matchLength {
+			matchLength = l
+			matchAddress = pos
+		}
+		return matchLength < maxPossible
+	}
+	for i, j := mid, mid-1; i < len(bucket) && int(bucket[i]) < hi || j >= first; i, j = i+1, j-1 {
+		if i < len(bucket) && int(bucket[i]) < hi && !try(int(bucket[i])) {
+			break
+		}
+		if j >= first && !try(int(bucket[j])) {
+			break
+		}
+	}
+
+	breakEven := 2 + deltaOffsetBits + int(w.lookahead)
+	if matchAddress == matchNotFound || 8*matchLength <= breakEven {
+		return matchNotFound, 0
+	}
+	w.referenceAddress = matchAddress
+	return matchAddress - w.referenceCursor + half, matchLength
+}
+
+// yieldReference copies count bytes of the current back-reference from the old image at the reference cursor
+func (r *reader) yieldReference(o *output, count int) decodeState {
+	buf := o.buf[o.index : o.index+count]
+	n, err := r.reference.ReadAt(buf, int64(r.referenceCursor))
+	if n < count {
+		if err == nil || err == io.EOF {
+			err = r.corrupt(ErrReference)
+		}
+		r.err = err
+		return decodeStateYieldBackRef
+	}
+	mask := (1 << r.window) - 1
+	for _, c := range buf {
+		r.windowBuffer[r.headIndex&mask] = c
+		r.headIndex++
+	}
+	o.index += count
+	r.outputOffset += int64(count)
+	r.referenceCursor += count
+	r.outputCount -= count
+	if r.outputCount == 0 {
+		return decodeStateTagBit
+	}
+	return decodeStateYieldBackRef
+}
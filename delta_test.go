@@ -0,0 +1,79 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// patched returns a copy of old with some bytes changed, a block inserted and a block removed, like a new firmware build
+func patched(old []byte) []byte {
+	b := append([]byte(nil), old[:len(old)/4]...)
+	b = append(b, random(3000)...)
+	b = append(b, old[len(old)/4:len(old)/2]...)
+	b = append(b, old[len(old)/2+500:]...)
+	for i := 100; i < len(b); i += 4093 {
+		b[i]++
+	}
+	return b
+}
+
+func TestDelta(t *testing.T) {
+	old := random(1 << 16)
+	new := patched(old)
+	for _, wl := range [][2]uint8{{8, 7}, {10, 8}, {12, 10}} {
+		window, lookahead := wl[0], wl[1]
+		var encoded bytes.Buffer
+		w := NewDeltaWriter(&encoded, old, Window(window), Lookahead(lookahead))
+		w.Write(new[:len(new)/2])
+		w.Flush()
+		w.Write(new[len(new)/2:])
+		err := w.Close()
+		if err != nil {
+			t.Fatalf("Window %d: error compressing: %v", window, err)
+		}
+		if encoded.Len() > len(new)/10 {
+			t.Errorf("Window %d: delta of %d bytes is larger than expected", window, encoded.Len())
+		}
+
+		r := NewDeltaReader(iotest.OneByteReader(bytes.NewReader(encoded.Bytes())), bytes.NewReader(old), Window(window), Lookahead(lookahead))
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Window %d: error decompressing: %v", window, err)
+		}
+		if !bytes.Equal(new, decompressed) {
+			t.Errorf("Window %d: decompressed data differs from original", window)
+		}
+
+		compressed := encoded.Bytes()
+		encoded.Reset()
+		w.Reset(&encoded)
+		w.Write(new[:len(new)/2])
+		w.Flush()
+		w.Write(new[len(new)/2:])
+		w.Close()
+		if !bytes.Equal(compressed, encoded.Bytes()) {
+			t.Errorf("Window %d: reset writer output differs", window)
+		}
+	}
+}
+
+func TestDeltaWrongImage(t *testing.T) {
+	old := random(1 << 12)
+	var encoded bytes.Buffer
+	w := NewDeltaWriter(&encoded, old)
+	w.Write(patched(old))
+	w.Close()
+
+	r := NewDeltaReader(bytes.NewReader(encoded.Bytes()), bytes.NewReader(old[:len(old)/2]))
+	decompressed, err := ioutil.ReadAll(r)
+	if !errors.Is(err, ErrReference) {
+		t.Errorf("Expected %v, got %v", ErrReference, err)
+	}
+	var corrupt *CorruptInputError
+	if !errors.As(err, &corrupt) || corrupt.Output != int64(len(decompressed)) || corrupt.State != "YieldBackRef" {
+		t.Errorf("Expected CorruptInputError after %d bytes of output, got %#v", len(decompressed), err)
+	}
+}
@@ -0,0 +1,30 @@
+package goheatshrink
+
+// Dictionary preloads the sliding window with data that is likely to occur in the input, so that back-references into it
+// can be used from the first byte. This helps most with small messages, which otherwise start with an empty window.
+// The same dictionary must be used to compress and decompress. Only the last 2^window bytes of the dictionary are used.
+func Dictionary(dictionary []byte) func(*config) {
+	return func(c *config) {
+		c.dictionary = dictionary
+	}
+}
+
+// dictionaryWindow returns the part of the dictionary which fits in the window
+func (c *config) dictionaryWindow() []byte {
+	d := c.dictionary
+	if windowLength := 1 << c.window; len(d) > windowLength {
+		d = d[len(d)-windowLength:]
+	}
+	return d
+}
+
+// loadDictionary fills the end of the backlog preceding the first input with the dictionary
+func (w *writer) loadDictionary(backlog []byte) {
+	d := w.dictionaryWindow()
+	copy(backlog[len(backlog)-len(d):], d)
+}
+
+// loadDictionary fills the window with the dictionary, as if it had just been decompressed
+func (r *reader) loadDictionary() {
+	r.headIndex = copy(r.windowBuffer, r.dictionaryWindow())
+}
@@ -1,13 +1,100 @@
 package goheatshrink
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	// ErrTruncated is returned when the input stream ended before decompression was complete
+	// ErrTruncated is returned when the input stream ended before decompression was complete. Readers, including
+	// container readers, return it wrapped in a CorruptInputError, so test for it with errors.Is.
 	ErrTruncated = errors.New("heatshrink: ran out of input before finishing")
 	// ErrBadStateOnClose is returned when the internal state machine was not in a finished state on Close
 	ErrBadStateOnClose = errors.New("heatshrink: state machine in bad state on close")
+	// ErrHeader is returned when a container header is malformed or uses an unsupported version or configuration
+	ErrHeader = errors.New("heatshrink: invalid container header")
+	// ErrChecksum is returned when the checksum in a container does not match the decompressed data
+	ErrChecksum = errors.New("heatshrink: invalid checksum")
+	// ErrContentLength is returned when the amount of data in a container does not match the length recorded in its header
+	ErrContentLength = errors.New("heatshrink: content length mismatch")
+	// ErrDictionary is returned when a container was compressed with a dictionary which was not given to the reader
+	ErrDictionary = errors.New("heatshrink: missing or wrong dictionary")
+	// ErrBackReference is returned by readers with Strict, wrapped in a CorruptInputError, for a back-reference reaching
+	// before the first byte of the stream
+	ErrBackReference = errors.New("heatshrink: back-reference before start of stream")
+	// ErrPadding is returned by readers with Strict, wrapped in a CorruptInputError, when the bits after the end of the
+	// last byte are not zero padding
+	ErrPadding = errors.New("heatshrink: invalid padding at end of stream")
+	// ErrOutputLimitExceeded is returned by readers and DecodeAll when the decompressed data is longer than MaxOutput
+	ErrOutputLimitExceeded = errors.New("heatshrink: output limit exceeded")
+	// ErrConfig is returned by NewWriterOptions and NewReaderOptions when an option value is out of range, or the
+	// lookahead is not less than the window
+	ErrConfig = errors.New("heatshrink: invalid configuration")
+	// ErrReference is returned, wrapped in a CorruptInputError, when a delta stream refers to data outside the old image
+	ErrReference = errors.New("heatshrink: back-reference outside old image")
+	// ErrBlockLost is wrapped by BlockLossError, returned when a block stream reader skips damaged or missing blocks
+	ErrBlockLost = errors.New("heatshrink: blocks lost")
 
 	errNoBitsAvailable  = errors.New("no available bits")
 	errOutputBufferFull = errors.New("output buffer full")
 )
+
+// StateError is returned when the state machine of a reader or writer reaches an invalid state, which means there is a
+// bug in this package or its memory was corrupted. The reader or writer fails with the same error until it is Reset.
+type StateError struct {
+	// Machine is "reader" or "writer"
+	Machine string
+	State   int
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("heatshrink: %s state machine in invalid state %d", e.Machine, e.State)
+}
+
+// CorruptInputError is returned by readers when the compressed input is invalid or ends too early, recording where
+// decoding stopped. Err is the reason, such as ErrTruncated, so errors.Is can be used to test for it.
+type CorruptInputError struct {
+	// Offset is the number of whole bytes of compressed input consumed before the failure
+	Offset int64
+	// Bit is the number of bits consumed from the byte after those
+	Bit int
+	// State is the name of the decoder state at the failure, or Header or Trailer for the parts of a container
+	// around the stream
+	State string
+	// Output is the number of bytes decompressed before the failure
+	Output int64
+	Err    error
+}
+
+func (e *CorruptInputError) Error() string {
+	return fmt.Sprintf("%v at input byte %d bit %d (state %s, output byte %d)", e.Err, e.Offset, e.Bit, e.State, e.Output)
+}
+
+func (e *CorruptInputError) Unwrap() error {
+	return e.Err
+}
+
+// BlockLossError is returned by readers created by NewBlockReader when damaged or missing blocks were skipped. It is
+// returned before the data of the next intact block, and reading can continue after it.
+type BlockLossError struct {
+	// Offset is the number of bytes of input before the first skipped byte, or before the frame following the lost
+	// blocks if nothing was skipped
+	Offset int64
+	// Skipped is the number of bytes of input skipped, which is 0 if whole frames went missing
+	Skipped int64
+	// First is the sequence number of the first lost block and Count the number of blocks lost, if the stream has sequence
+	// numbers. Count is 0 if it is not known.
+	First uint32
+	Count uint32
+}
+
+func (e *BlockLossError) Error() string {
+	if e.Count == 0 {
+		return fmt.Sprintf("heatshrink: skipped %d damaged bytes at input byte %d", e.Skipped, e.Offset)
+	}
+	return fmt.Sprintf("heatshrink: lost %d blocks from block %d, skipping %d bytes at input byte %d", e.Count, e.First, e.Skipped, e.Offset)
+}
+
+func (e *BlockLossError) Unwrap() error {
+	return ErrBlockLost
+}
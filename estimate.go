@@ -0,0 +1,64 @@
+package goheatshrink
+
+import "io"
+
+// Estimator is an io.WriteCloser which measures how large the data written to it would be compressed, without producing
+// the compressed output. It is faster than compressing to io.Discard.
+type Estimator interface {
+	io.WriteCloser
+	// Size returns the number of bytes of compressed output so far. After Close, it is the length of the whole stream a
+	// WriteResetter with the same options would have written.
+	Size() int64
+	// Reset discards the data written so far, to measure another stream
+	Reset()
+}
+
+type estimator struct {
+	inner *writer
+}
+
+// NewEstimator creates a new Estimator.
+//
+// options modifies the default configuration values to use when compressing. Invalid option values are clamped to the
+// nearest valid value, as by NewWriter.
+func NewEstimator(options ...func(*config)) Estimator {
+	w, _ := newWriter(discard{}, options...)
+	w.counting = true
+	return &estimator{inner: w}
+}
+
+func (e *estimator) Write(p []byte) (int, error) {
+	return e.inner.Write(p)
+}
+
+func (e *estimator) Close() error {
+	return e.inner.Close()
+}
+
+func (e *estimator) Size() int64 {
+	return e.inner.countedSize()
+}
+
+func (e *estimator) Reset() {
+	e.inner.Reset(discard{})
+}
+
+// countedSize returns the number of bytes counted by an estimator, including the last partial byte
+func (w *writer) countedSize() int64 {
+	return (w.countedBits + 7) / 8
+}
+
+// discard is the output of estimators, which never write to it
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discard) WriteByte(b byte) error {
+	return nil
+}
+
+func (discard) Flush() error {
+	return nil
+}
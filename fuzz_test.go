@@ -0,0 +1,89 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// fuzzConfig maps arbitrary bytes to a valid window and lookahead
+func fuzzConfig(window uint8, lookahead uint8) (uint8, uint8) {
+	window = MinWindow + window%(MaxWindow-MinWindow+1)
+	lookahead = MinLookahead + lookahead%(window-MinLookahead)
+	return window, lookahead
+}
+
+const fuzzMaxOutput = 1 << 20
+
+// FuzzReader decodes arbitrary input, which must not panic, hang or produce more than MaxOutput. NewReader and DecodeAll
+// must agree on the output and on whether it is valid.
+func FuzzReader(f *testing.F) {
+	f.Add([]byte{}, uint8(8), uint8(4), false)
+	f.Add(EncodeAll(nil, []byte("abcabcdabcdeabcdefabcdefg")), uint8(8), uint8(4), false)
+	f.Add(EncodeAll(nil, make([]byte, 1000), Window(4), Lookahead(3)), uint8(4), uint8(3), false)
+	f.Add(EncodeAll(nil, []byte("strict strict strict"), Strict()), uint8(8), uint8(4), true)
+	f.Fuzz(func(t *testing.T, data []byte, window uint8, lookahead uint8, strict bool) {
+		window, lookahead = fuzzConfig(window, lookahead)
+		options := []func(*config){Window(window), Lookahead(lookahead), MaxOutput(fuzzMaxOutput)}
+		if strict {
+			options = append(options, Strict())
+		}
+
+		decoded, err := DecodeAll(nil, data, options...)
+		if len(decoded) > fuzzMaxOutput {
+			t.Fatalf("DecodeAll produced %d bytes, more than MaxOutput", len(decoded))
+		}
+		r := NewReader(iotest.OneByteReader(bytes.NewReader(data)), options...)
+		read, readErr := ioutil.ReadAll(r)
+		if len(read) > fuzzMaxOutput {
+			t.Fatalf("Reader produced %d bytes, more than MaxOutput", len(read))
+		}
+		if (err == nil) != (readErr == nil) || !bytes.Equal(decoded, read) {
+			t.Fatalf("DecodeAll returned %d bytes (%v), Reader %d bytes (%v)", len(decoded), err, len(read), readErr)
+		}
+		var corrupt *CorruptInputError
+		if err != nil && err != ErrOutputLimitExceeded && !errors.As(err, &corrupt) {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	})
+}
+
+// FuzzRoundTrip compresses arbitrary data with every level, written in chunks of an arbitrary size, and checks it
+// decompresses to the original.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{}, uint8(8), uint8(4), uint16(0))
+	f.Add([]byte("abcabcdabcdeabcdefabcdefg"), uint8(8), uint8(4), uint16(3))
+	f.Add(make([]byte, 1000), uint8(4), uint8(3), uint16(1))
+	f.Add(bytes.Repeat([]byte("heatshrink "), 100), uint8(12), uint8(6), uint16(100))
+	f.Fuzz(func(t *testing.T, data []byte, window uint8, lookahead uint8, chunk uint16) {
+		window, lookahead = fuzzConfig(window, lookahead)
+		chunkSize := 1 + int(chunk)%(len(data)+1)
+		for level := MinLevel; level <= MaxLevel; level++ {
+			var encoded bytes.Buffer
+			w := NewWriter(&encoded, Window(window), Lookahead(lookahead), Level(level))
+			for p := data; len(p) > 0; {
+				n := chunkSize
+				if n > len(p) {
+					n = len(p)
+				}
+				_, err := w.Write(p[:n])
+				if err != nil {
+					t.Fatalf("Level %d: error compressing: %v", level, err)
+				}
+				p = p[n:]
+			}
+			err := w.Close()
+			if err != nil {
+				t.Fatalf("Level %d: error closing: %v", level, err)
+			}
+
+			r := NewReader(bytes.NewReader(encoded.Bytes()), Window(window), Lookahead(lookahead))
+			decompressed, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(data, decompressed) {
+				t.Fatalf("Level %d: decompressed %d of %d bytes (%v)", level, len(decompressed), len(data), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/currantlabs/goheatshrink"
+)
+
+// delta writes the difference between the images in oldFile and newFile to patchFile
+func delta(oldFile string, newFile string, patchFile string, window uint8, lookahead uint8) {
+	old, err := ioutil.ReadFile(oldFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	in, err := os.Open(newFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(patchFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+
+	w := goheatshrink.NewDeltaWriter(out, old, goheatshrink.ExtendedWindow(window), goheatshrink.Lookahead(lookahead))
+	_, err = io.Copy(w, in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// patch applies the delta in patchFile to the image in oldFile, writing the new image to newFile.
+// The old image is read as needed, as it would be from flash on a device.
+func patch(oldFile string, patchFile string, newFile string, window uint8, lookahead uint8) {
+	old, err := os.Open(oldFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer old.Close()
+	in, err := os.Open(patchFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(newFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+
+	r := goheatshrink.NewDeltaReader(bufio.NewReader(in), old, goheatshrink.ExtendedWindow(window), goheatshrink.Lookahead(lookahead))
+	_, err = io.Copy(out, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 
@@ -16,17 +18,74 @@ var (
 	decode  = kingpin.Flag("decode", "decode (decompress)").Short('d').Bool()
 	verbose = kingpin.Flag("verbose", "verbose (print input & output sizes, compression ratio, etc.)").Short('v').Bool()
 
-	window    = kingpin.Flag("window", "Base-2 log of LZSS sliding window size").Short('w').Default("8").Int()
+	window    = kingpin.Flag("window", "Base-2 log of LZSS sliding window size, windows above 16 cannot be decoded by the C library").Short('w').Default("8").Int()
 	lookahead = kingpin.Flag("lookahead", "Number of bits used for back-reference lengths").Short('l').Default("4").Int()
-
-	inFile  = kingpin.Arg("IN_FILE", "The file to process.").String()
-	outFile = kingpin.Arg("OUT_FILE", "The file to write to").String()
+	level     = kingpin.Flag("level", "Compression level, from 1 (greedy, fastest) to 4 (optimal parse of the whole input, smallest)").Default("1").Int()
+	container = kingpin.Flag("container", "Wrap encoded output in a header recording window & lookahead (--no-container for a raw stream)").Short('c').Default("true").Bool()
+	dictFile  = kingpin.Flag("dictionary", "File containing a preset dictionary, as built by the train command").Short('D').String()
+	best      = kingpin.Flag("best", "Encode with the window & lookahead giving the smallest output for the input, instead of -w & -l").Bool()
+	maxMemory = kingpin.Flag("max-memory", "The most bytes of sliding window the decoder can allocate, requires --best").Int()
+
+	processCommand = kingpin.Command("process", "Compress or decompress a file (default)").Default()
+	inFile         = processCommand.Arg("IN_FILE", "The file to process.").String()
+	outFile        = processCommand.Arg("OUT_FILE", "The file to write to").String()
+
+	trainCommand = kingpin.Command("train", "Build a dictionary from a directory of sample payloads")
+	sampleDir    = trainCommand.Arg("SAMPLE_DIR", "The directory of sample payloads").Required().ExistingDir()
+	trainFile    = trainCommand.Arg("DICTIONARY_FILE", "The file to write the dictionary to").Required().String()
+	trainSize    = trainCommand.Flag("size", "Dictionary size in bytes, at most 2^window (default 2^window)").Int()
+
+	deltaCommand = kingpin.Command("delta", "Compress a new firmware image as the difference from an old one")
+	deltaOld     = deltaCommand.Arg("OLD_FILE", "The old image").Required().ExistingFile()
+	deltaNew     = deltaCommand.Arg("NEW_FILE", "The new image").Required().ExistingFile()
+	deltaPatch   = deltaCommand.Arg("PATCH_FILE", "The file to write the delta to").Required().String()
+
+	patchCommand = kingpin.Command("patch", "Apply a delta written by the delta command to an old image")
+	patchOld     = patchCommand.Arg("OLD_FILE", "The old image").Required().ExistingFile()
+	patchPatch   = patchCommand.Arg("PATCH_FILE", "The delta").Required().ExistingFile()
+	patchNew     = patchCommand.Arg("NEW_FILE", "The file to write the new image to").Required().String()
 )
 
 func main() {
 
 	kingpin.Version("0.1")
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	// Fail before creating any output if the settings are invalid
+	if *maxMemory != 0 && !*best {
+		log.Fatal("--max-memory needs --best")
+	}
+	switch command {
+	case trainCommand.FullCommand():
+		c := settings()
+		train(*sampleDir, *trainFile, *trainSize, c.Window, c.Lookahead)
+		return
+	case deltaCommand.FullCommand():
+		c := settings()
+		delta(*deltaOld, *deltaNew, *deltaPatch, c.Window, c.Lookahead)
+		return
+	case patchCommand.FullCommand():
+		c := settings()
+		patch(*patchOld, *patchPatch, *patchNew, c.Window, c.Lookahead)
+		return
+	}
+	if *decode {
+		settings()
+	} else {
+		checkLevel()
+		if !*best {
+			settings()
+		}
+	}
+
+	var dictionary []byte
+	if *dictFile != "" {
+		var err error
+		dictionary, err = ioutil.ReadFile(*dictFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	var s counter
 	var writer io.WriteCloser
@@ -68,22 +127,66 @@ func main() {
 			ir = rs
 		}
 		writer = out
-		reader = goheatshrink.NewReader(ir, goheatshrink.Window(uint8(*window)), goheatshrink.Lookahead(uint8(*lookahead)))
+		var err error
+		reader, err = goheatshrink.NewContainerReader(ir, goheatshrink.ExtendedWindow(uint8(*window)), goheatshrink.Lookahead(uint8(*lookahead)), goheatshrink.Dictionary(dictionary))
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else if *encode {
+		reader = in
+		if *best {
+			data, err := ioutil.ReadAll(in)
+			if err != nil {
+				log.Fatal(err)
+			}
+			c, err := goheatshrink.Optimize(data, goheatshrink.Constraints{MaxDecoderMemory: *maxMemory}, goheatshrink.Level(uint8(*level)), goheatshrink.Dictionary(dictionary))
+			if err != nil {
+				log.Fatal(err)
+			}
+			*window, *lookahead = int(c.Window), int(c.Lookahead)
+			if !*container {
+				// The raw stream does not record the settings, which are needed to decode it
+				fmt.Fprintf(os.Stderr, "-w %d -l %d\n", c.Window, c.Lookahead)
+			}
+			reader = bytes.NewReader(data)
+		}
 		var wc io.WriteCloser = out
 		if *verbose {
 			ws := &writeSnoop{WriteCloser: wc}
 			s = ws
 			wc = ws
 		}
-		writer = goheatshrink.NewWriter(wc, goheatshrink.Window(uint8(*window)), goheatshrink.Lookahead(uint8(*lookahead)))
-		reader = in
+		if *container {
+			writer = goheatshrink.NewContainerWriter(wc, goheatshrink.ExtendedWindow(uint8(*window)), goheatshrink.Lookahead(uint8(*lookahead)), goheatshrink.Level(uint8(*level)), goheatshrink.Dictionary(dictionary))
+		} else {
+			writer = goheatshrink.NewWriter(wc, goheatshrink.ExtendedWindow(uint8(*window)), goheatshrink.Lookahead(uint8(*lookahead)), goheatshrink.Level(uint8(*level)), goheatshrink.Dictionary(dictionary))
+		}
 	} else {
 		log.Fatal(errors.New("Must provide either encode or decode"))
 	}
 	process(reader, writer, reporter, *outFile, s, uint8(*window), uint8(*lookahead))
 }
 
+// settings returns the window & lookahead flags, exiting if they are invalid
+func settings() goheatshrink.Config {
+	if *window < 0 || *window > 255 || *lookahead < 0 || *lookahead > 255 {
+		log.Fatalf("window %d or lookahead %d is out of range", *window, *lookahead)
+	}
+	c := goheatshrink.Config{Window: uint8(*window), Lookahead: uint8(*lookahead)}
+	err := c.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// checkLevel exits if the level flag, used only when encoding, is invalid
+func checkLevel() {
+	if *level < int(goheatshrink.MinLevel) || *level > int(goheatshrink.MaxLevel) {
+		log.Fatalf("level %d is outside %d to %d", *level, goheatshrink.MinLevel, goheatshrink.MaxLevel)
+	}
+}
+
 func process(in io.Reader, out io.WriteCloser, reporter *os.File, outFile string, s counter, w uint8, l uint8) {
 	n, err := io.Copy(out, in)
 	if err != nil {
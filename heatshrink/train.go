@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/currantlabs/goheatshrink"
+)
+
+const (
+	// Length of the substrings counted across samples
+	kmerLength = 4
+	// Length of the pieces of samples copied into the dictionary
+	segmentLength = 32
+)
+
+// train builds a dictionary of at most size bytes from the files in dir, writes it to outFile and reports how much it
+// improves compression of the samples.
+func train(dir string, outFile string, size int, window uint8, lookahead uint8) {
+	if window > goheatshrink.MaxWindow {
+		log.Fatalf("Window %d is above %d, the largest a dictionary is trained for", window, goheatshrink.MaxWindow)
+	}
+	if maxSize := 1 << window; size <= 0 || size > maxSize {
+		if size > maxSize {
+			log.Printf("Dictionary size %d is larger than the window, using %d", size, maxSize)
+		}
+		size = maxSize
+	}
+
+	samples, err := loadSamples(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(samples) == 0 {
+		log.Fatalf("No samples found in %s", dir)
+	}
+
+	dictionary := buildDictionary(samples, size)
+	err = ioutil.WriteFile(outFile, dictionary, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var total, without, with int
+	for _, sample := range samples {
+		total += len(sample)
+		without += len(goheatshrink.EncodeAll(nil, sample, goheatshrink.Window(window), goheatshrink.Lookahead(lookahead)))
+		with += len(goheatshrink.EncodeAll(nil, sample, goheatshrink.Window(window), goheatshrink.Lookahead(lookahead), goheatshrink.Dictionary(dictionary)))
+	}
+	fmt.Printf("%d samples, %d bytes (-w %d -l %d)\n", len(samples), total, window, lookahead)
+	fmt.Printf("without dictionary:\t%d bytes %0.2f%%\n", without, 100.0-(100.0*float64(without))/float64(total))
+	fmt.Printf("with %d byte dictionary:\t%d bytes %0.2f%%\n", len(dictionary), with, 100.0-(100.0*float64(with))/float64(total))
+}
+
+func loadSamples(dir string) ([][]byte, error) {
+	var samples [][]byte
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		sample, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, sample)
+		return nil
+	})
+	return samples, err
+}
+
+// buildDictionary repeatedly picks the segment of the samples containing the most substrings shared with other samples,
+// until size bytes have been picked. Substrings are only counted once, so later segments cover what earlier ones missed.
+// The best segments go at the end of the dictionary, which stays in the window the longest.
+func buildDictionary(samples [][]byte, size int) []byte {
+	// The number of other samples each substring appears in
+	weights := make(map[uint32]int)
+	kmers := make([][]uint32, len(samples))
+	for i, sample := range samples {
+		seen := make(map[uint32]bool)
+		for j := 0; j+kmerLength <= len(sample); j++ {
+			k := binary.BigEndian.Uint32(sample[j:])
+			kmers[i] = append(kmers[i], k)
+			if !seen[k] {
+				seen[k] = true
+				weights[k]++
+			}
+		}
+	}
+	for k := range weights {
+		weights[k]--
+	}
+
+	var segments [][]byte
+	for remaining := size; remaining > 0; {
+		var best []byte
+		var bestScore int
+		for i, sample := range samples {
+			n := segmentLength
+			if n > remaining {
+				n = remaining
+			}
+			if n > len(sample) {
+				n = len(sample)
+			}
+			// Number of substrings in a segment of n bytes
+			count := n - kmerLength + 1
+			if count <= 0 {
+				continue
+			}
+			score := 0
+			for _, k := range kmers[i][:count] {
+				score += weights[k]
+			}
+			for start := 0; ; start++ {
+				if score > bestScore {
+					best = sample[start : start+n]
+					bestScore = score
+				}
+				if start+count >= len(kmers[i]) {
+					break
+				}
+				score += weights[kmers[i][start+count]] - weights[kmers[i][start]]
+			}
+		}
+		if best == nil {
+			break
+		}
+		segments = append(segments, best)
+		remaining -= len(best)
+		for j := 0; j+kmerLength <= len(best); j++ {
+			weights[binary.BigEndian.Uint32(best[j:])] = 0
+		}
+	}
+
+	dictionary := make([]byte, 0, size)
+	for i := len(segments) - 1; i >= 0; i-- {
+		dictionary = append(dictionary, segments[i]...)
+	}
+	return dictionary
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/currantlabs/goheatshrink"
+)
+
+// message returns a small telemetry record, like those a dictionary is trained for
+func message(r *rand.Rand) []byte {
+	return []byte(fmt.Sprintf(`{"device":"sensor-%02d","temperature":%d.%d,"humidity":%d,"battery":%d,"status":"%s"}`,
+		r.Intn(20), 15+r.Intn(15), r.Intn(10), 20+r.Intn(60), r.Intn(100), []string{"ok", "charging", "low"}[r.Intn(3)]))
+}
+
+func TestBuildDictionary(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, message(r))
+	}
+	dictionary := buildDictionary(samples, 256)
+	if len(dictionary) == 0 || len(dictionary) > 256 {
+		t.Fatalf("Expected a dictionary of at most 256 bytes, got %d", len(dictionary))
+	}
+
+	// Messages not used for training compress smaller with the dictionary
+	var without, with int
+	for i := 0; i < 50; i++ {
+		heldOut := message(r)
+		without += len(goheatshrink.EncodeAll(nil, heldOut, goheatshrink.Window(8), goheatshrink.Lookahead(4)))
+		with += len(goheatshrink.EncodeAll(nil, heldOut, goheatshrink.Window(8), goheatshrink.Lookahead(4), goheatshrink.Dictionary(dictionary)))
+	}
+	if with >= without {
+		t.Errorf("Held-out messages took %d bytes with the dictionary, %d without", with, without)
+	}
+}
@@ -2,12 +2,16 @@ package goheatshrink
 
 import (
 	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -57,6 +61,748 @@ func TestRandomBigWindow(t *testing.T) {
 	testRoundTrip(t, testdata, 16, 4)
 }
 
+func TestOptionErrors(t *testing.T) {
+	invalid := map[string][]func(*config){
+		"window too small":          {Window(MinWindow - 1)},
+		"window too large":          {Window(MaxWindow + 1)},
+		"extended window too large": {ExtendedWindow(MaxExtendedWindow + 1)},
+		"lookahead too small":       {Lookahead(MinLookahead - 1)},
+		"lookahead equals window":   {Window(8), Lookahead(8)},
+		"lookahead exceeds window":  {Window(5), Lookahead(12)},
+		"level too small":           {Level(MinLevel - 1)},
+		"level too large":           {Level(MaxLevel + 1)},
+		"negative chain length":     {MaxChainLength(-1)},
+		"block size too large":      {BlockSize(MaxBlockSize + 1)},
+	}
+	for name, options := range invalid {
+		_, err := NewWriterOptions(ioutil.Discard, options...)
+		if !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected writer %v, got %v", name, ErrConfig, err)
+		}
+		_, err = NewReaderOptions(bytes.NewReader(nil), options...)
+		if !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected reader %v, got %v", name, ErrConfig, err)
+		}
+		_, err = DecodeAll(nil, nil, options...)
+		if !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected DecodeAll %v, got %v", name, ErrConfig, err)
+		}
+	}
+
+	_, err := NewWriterOptions(ioutil.Discard, ExtendedWindow(20), Lookahead(8), Level(MaxLevel), MaxChainLength(16))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Without error reporting, a lookahead too long for the window is used as given
+	testdata := text(1 << 12)
+	compressed := EncodeAll(nil, testdata, Window(5), Lookahead(12))
+	decompressed, err := ioutil.ReadAll(NewReader(bytes.NewReader(compressed), Window(5), Lookahead(12)))
+	if err != nil || !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Decompressed data differs from original (%v)", err)
+	}
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer, Window(5), Lookahead(12))
+	w.Write(testdata)
+	w.Close()
+	if !bytes.Equal(compressed, buffer.Bytes()) {
+		t.Errorf("NewWriter output differs from EncodeAll")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	w := NewWriter(ioutil.Discard, Window(10), Lookahead(5))
+	c := w.(Configurer).Config()
+	if c != (Config{Window: 10, Lookahead: 5}) {
+		t.Errorf("Expected w10l5, got %v", c)
+	}
+	text, err := c.MarshalText()
+	if err != nil || string(text) != "w10l5" {
+		t.Errorf("Expected w10l5, got %s (%v)", text, err)
+	}
+	var parsed Config
+	err = parsed.UnmarshalText(text)
+	if err != nil || parsed != c {
+		t.Errorf("Expected %v, got %v (%v)", c, parsed, err)
+	}
+	r := NewReader(bytes.NewReader(nil), WithConfig(parsed))
+	if rc := r.(Configurer).Config(); rc != c {
+		t.Errorf("Expected reader %v, got %v", c, rc)
+	}
+
+	// A writer reports a lookahead not less than its window, so its settings must parse back
+	w = NewWriter(ioutil.Discard, Window(8), Lookahead(8))
+	text, _ = w.(Configurer).Config().MarshalText()
+	err = parsed.UnmarshalText(text)
+	if err != nil || parsed != (Config{Window: 8, Lookahead: 8}) {
+		t.Errorf("Expected w8l8, got %v (%v)", parsed, err)
+	}
+	if err = parsed.Validate(); !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected %v, got %v", ErrConfig, err)
+	}
+	parsed = c
+
+	for _, invalid := range []string{"", "w8", "w8l4x", "w08l4", "w2l1", "w300l4", "l4w8"} {
+		err = parsed.UnmarshalText([]byte(invalid))
+		if !errors.Is(err, ErrConfig) {
+			t.Errorf("%q: expected %v, got %v", invalid, ErrConfig, err)
+		}
+	}
+	if parsed != c {
+		t.Errorf("Failed UnmarshalText changed the Config to %v", parsed)
+	}
+}
+
+func TestLargeWindows(t *testing.T) {
+	for _, window := range []uint8{15, 16, 20} {
+		// Repeats at a distance only the full window can reach
+		testdata := random(1<<(window-1) + 1000)
+		testdata = append(testdata, testdata...)
+		compressed := EncodeAll(nil, testdata, ExtendedWindow(window), Lookahead(8))
+		if len(compressed) > len(testdata)*3/4 {
+			t.Errorf("Window %d: compressed %d bytes to %d", window, len(testdata), len(compressed))
+		}
+		r := NewReader(iotest.OneByteReader(bytes.NewReader(compressed)), ExtendedWindow(window), Lookahead(8))
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Window %d: error decompressing: %v", window, err)
+		}
+		if !bytes.Equal(testdata, decompressed) {
+			t.Errorf("Window %d: decompressed data differs from original", window)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	for _, lookahead := range []uint8{3, 4, 7} {
+		messages := [][]byte{
+			[]byte("temperature=21.5 humidity=40"),
+			[]byte("temperature=21.5 humidity=41"),
+			[]byte("x"),
+			[]byte("temperature=21.6 humidity=41"),
+		}
+		var encoded bytes.Buffer
+		w := NewWriter(&encoded, Window(8), Lookahead(lookahead))
+		var expected []byte
+		var previous int
+		for i, m := range messages {
+			w.Write(m)
+			err := w.Flush()
+			if err != nil {
+				t.Fatalf("Error flushing: %v", err)
+			}
+			expected = append(expected, m...)
+			if i == 1 && encoded.Len()-previous >= previous {
+				t.Errorf("Second message not compressed against the first: %d bytes after %d", encoded.Len()-previous, previous)
+			}
+			previous = encoded.Len()
+
+			decompressed, err := decompress(encoded.Bytes(), 8, lookahead)
+			if err != nil {
+				t.Fatalf("Error decompressing after message %d: %v", i, err)
+			}
+			if !bytes.Equal(expected, decompressed) {
+				t.Fatalf("After message %d: expected %q decompressed %q", i, expected, decompressed)
+			}
+		}
+		w.Close()
+		decompressed, err := decompress(encoded.Bytes(), 8, lookahead)
+		if err != nil {
+			t.Fatalf("Error decompressing: %v", err)
+		}
+		if !bytes.Equal(expected, decompressed) {
+			t.Errorf("Expected %q decompressed %q", expected, decompressed)
+		}
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	payloads := [][]byte{
+		random(1 << 12),
+		[]byte("abcabcdabcdeabcdefabcdefgabcdefgh"),
+		{},
+		bytes.Repeat([]byte{0, 1, 2, 3}, 1<<10),
+	}
+	var reused bytes.Buffer
+	w := NewWriter(&reused, Window(9), Lookahead(5))
+	// Leave a partially written stream behind, which Reset must discard
+	w.Write(random(1 << 10))
+	for i, p := range payloads {
+		reused.Reset()
+		w.Reset(&reused)
+		w.Write(p)
+		w.Close()
+
+		var fresh bytes.Buffer
+		f := NewWriter(&fresh, Window(9), Lookahead(5))
+		f.Write(p)
+		f.Close()
+
+		if !bytes.Equal(fresh.Bytes(), reused.Bytes()) {
+			t.Errorf("Payload %d: reset writer output differs from fresh writer output", i)
+		}
+	}
+}
+
+func TestInvalidState(t *testing.T) {
+	w := NewWriter(ioutil.Discard).(*writer)
+	w.Write(text(100))
+	w.state = encodeStateInvalid
+	err := w.Flush()
+	var stateErr *StateError
+	if !errors.As(err, &stateErr) || stateErr.Machine != "writer" {
+		t.Errorf("Expected writer StateError, got %v", err)
+	}
+	if _, err := w.Write(text(1000)); err != stateErr {
+		t.Errorf("Write: expected %v, got %v", stateErr, err)
+	}
+	if err := w.Close(); err != stateErr {
+		t.Errorf("Close: expected %v, got %v", stateErr, err)
+	}
+	w.Reset(ioutil.Discard)
+	w.Write(text(100))
+	if err := w.Close(); err != nil {
+		t.Errorf("Close after Reset: %v", err)
+	}
+
+	compressed := EncodeAll(nil, text(1000))
+	r := NewReader(bytes.NewReader(compressed)).(*reader)
+	r.state = decodeState(99)
+	_, err = ioutil.ReadAll(r)
+	if !errors.As(err, &stateErr) || stateErr.Machine != "reader" || stateErr.State != 99 {
+		t.Errorf("Expected reader StateError, got %v", err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err != stateErr {
+		t.Errorf("Read: expected %v, got %v", stateErr, err)
+	}
+}
+
+func TestCorruptInputError(t *testing.T) {
+	// The 12 bit high part of each offset can span the end of the input, leaving the reader waiting for more
+	testdata := text(1 << 14)
+	compressed := EncodeAll(nil, testdata, ExtendedWindow(20), Lookahead(8))
+	truncated := 0
+	for cut := 1; cut < 64; cut++ {
+		input := compressed[:len(compressed)-cut]
+		_, err := DecodeAll(nil, input, ExtendedWindow(20), Lookahead(8))
+		if err == nil {
+			continue
+		}
+		var corrupt *CorruptInputError
+		if !errors.As(err, &corrupt) || !errors.Is(err, ErrTruncated) {
+			t.Fatalf("Cut %d: expected truncated CorruptInputError, got %v", cut, err)
+		}
+		if corrupt.Offset*8+int64(corrupt.Bit) > int64(len(input))*8 || corrupt.Output > int64(len(testdata)) {
+			t.Errorf("Cut %d: position %v outside input", cut, err)
+		}
+		truncated++
+
+		r := NewReader(bytes.NewReader(input), ExtendedWindow(20), Lookahead(8))
+		decompressed, readErr := ioutil.ReadAll(r)
+		var readCorrupt *CorruptInputError
+		if !errors.As(readErr, &readCorrupt) || *readCorrupt != *corrupt || readCorrupt.Output != int64(len(decompressed)) {
+			t.Errorf("Cut %d: expected Read to fail like DecodeAll with %v, got %v", cut, err, readErr)
+		}
+	}
+	if truncated == 0 {
+		t.Errorf("No truncated input detected")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	testdata := append(make([]byte, 100), text(1<<12)...)
+	for level := MinLevel; level <= MaxLevel; level++ {
+		var encoded bytes.Buffer
+		w := NewWriter(&encoded, Level(level), Strict())
+		w.Write(testdata[:1000])
+		w.Flush()
+		w.Write(testdata[1000:])
+		w.Close()
+		decompressed, err := DecodeAll(nil, encoded.Bytes(), Strict())
+		if err != nil || !bytes.Equal(testdata, decompressed) {
+			t.Errorf("Level %d: strict decoding failed (%v)", level, err)
+		}
+	}
+
+	// Without Strict, the leading zeros are encoded as a back-reference into the window before the stream
+	compressed := EncodeAll(nil, testdata)
+	_, err := DecodeAll(nil, compressed, Strict())
+	if !errors.Is(err, ErrBackReference) {
+		t.Errorf("Expected %v, got %v", ErrBackReference, err)
+	}
+	r := NewReader(bytes.NewReader(compressed), Strict())
+	_, err = ioutil.ReadAll(r)
+	if !errors.Is(err, ErrBackReference) {
+		t.Errorf("Expected reader %v, got %v", ErrBackReference, err)
+	}
+
+	dictionary := []byte("zero zero zero")
+	compressed = EncodeAll(nil, []byte("zero zero zero zero"), Dictionary(dictionary), Strict())
+	decompressed, err := DecodeAll(nil, compressed, Dictionary(dictionary), Strict())
+	if err != nil || string(decompressed) != "zero zero zero zero" {
+		t.Errorf("Strict decoding with dictionary failed: %q (%v)", decompressed, err)
+	}
+
+	// A single literal is followed by 7 bits of padding
+	compressed = EncodeAll(nil, []byte("a"))
+	compressed[len(compressed)-1] |= 1
+	decompressed, err = DecodeAll(nil, compressed)
+	if err != nil || string(decompressed) != "a" {
+		t.Errorf("Expected %q, got %q (%v)", "a", decompressed, err)
+	}
+	_, err = DecodeAll(nil, compressed, Strict())
+	if !errors.Is(err, ErrPadding) {
+		t.Errorf("Expected %v, got %v", ErrPadding, err)
+	}
+	r = NewReader(bytes.NewReader(compressed), Strict())
+	_, err = ioutil.ReadAll(r)
+	if !errors.Is(err, ErrPadding) {
+		t.Errorf("Expected reader %v, got %v", ErrPadding, err)
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	bomb := EncodeAll(nil, make([]byte, 1<<20), Lookahead(7))
+	r := NewReader(bytes.NewReader(bomb), Lookahead(7), MaxOutput(1000))
+	decompressed, err := ioutil.ReadAll(r)
+	if err != ErrOutputLimitExceeded || len(decompressed) != 1000 {
+		t.Errorf("Expected %v after 1000 bytes, got %v after %d", ErrOutputLimitExceeded, err, len(decompressed))
+	}
+	decompressed, err = DecodeAll(nil, bomb, Lookahead(7), MaxOutput(1000))
+	if err != ErrOutputLimitExceeded || len(decompressed) != 1000 {
+		t.Errorf("Expected DecodeAll %v after 1000 bytes, got %v after %d", ErrOutputLimitExceeded, err, len(decompressed))
+	}
+
+	// The limit shortens the slice passed to the decoder, which must not write past its length
+	r = NewReader(bytes.NewReader(bomb), Lookahead(7), MaxOutput(1000))
+	p := make([]byte, 1<<10)
+	for total := 0; total < 1000; {
+		n, err := r.Read(p[:300])
+		if n > 300 || err != nil {
+			t.Fatalf("Read %d bytes into 300 (%v)", n, err)
+		}
+		total += n
+	}
+
+	testdata := text(1 << 12)
+	compressed := EncodeAll(nil, testdata)
+	r = NewReader(bytes.NewReader(compressed), MaxOutput(int64(len(testdata))))
+	decompressed, err = ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Output at the limit failed (%v)", err)
+	}
+	decompressed, err = DecodeAll(nil, compressed, MaxOutput(int64(len(testdata))))
+	if err != nil || !bytes.Equal(testdata, decompressed) {
+		t.Errorf("DecodeAll output at the limit failed (%v)", err)
+	}
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+func (failingWriter) WriteByte(b byte) error {
+	return errWrite
+}
+
+func (failingWriter) Flush() error {
+	return errWrite
+}
+
+func TestWriteErrorSticky(t *testing.T) {
+	for level := MinLevel; level <= MaxLevel; level++ {
+		w := NewWriter(failingWriter{}, Level(level))
+		w.Write(text(1 << 10))
+		if err := w.Close(); err != errWrite {
+			t.Errorf("Level %d: expected %v, got %v", level, errWrite, err)
+		}
+		if _, err := w.Write(text(10)); err != errWrite {
+			t.Errorf("Level %d: Write after failure: expected %v, got %v", level, errWrite, err)
+		}
+		if err := w.Close(); err != errWrite {
+			t.Errorf("Level %d: Close after failure: expected %v, got %v", level, errWrite, err)
+		}
+	}
+}
+
+func TestEncodeAllDecodeAll(t *testing.T) {
+	testdata := random(1 << 12)
+	testdata = append(testdata, testdata[:1<<10]...)
+	for _, window := range []uint8{5, 8, 12} {
+		expected, err := compress(testdata, window, 4)
+		if err != nil {
+			t.Fatalf("Error compressing: %v", err)
+		}
+		prefix := []byte("prefix")
+		encoded := EncodeAll(prefix, testdata, Window(window), Lookahead(4))
+		if !bytes.Equal(encoded[:len(prefix)], prefix) || !bytes.Equal(encoded[len(prefix):], expected) {
+			t.Errorf("Window %d: EncodeAll output differs from NewWriter output", window)
+		}
+		decoded, err := DecodeAll(prefix, encoded[len(prefix):], Window(window), Lookahead(4))
+		if err != nil {
+			t.Fatalf("Error decompressing: %v", err)
+		}
+		if !bytes.Equal(decoded[:len(prefix)], prefix) || !bytes.Equal(decoded[len(prefix):], testdata) {
+			t.Errorf("Window %d: DecodeAll output differs from original", window)
+		}
+	}
+}
+
+func TestEncodeAllDecodeAllAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	testdata := random(1 << 10)
+	options := []func(*config){Window(9), Lookahead(5)}
+	encoded := EncodeAll(nil, testdata, options...)
+	encodeBuffer := make([]byte, 0, 2*len(testdata))
+	decodeBuffer := make([]byte, 0, len(testdata))
+	allocs := testing.AllocsPerRun(100, func() {
+		EncodeAll(encodeBuffer, testdata, options...)
+	})
+	if allocs != 0 {
+		t.Errorf("EncodeAll: %v allocations per call", allocs)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		DecodeAll(decodeBuffer, encoded, options...)
+	})
+	if allocs != 0 {
+		t.Errorf("DecodeAll: %v allocations per call", allocs)
+	}
+}
+
+func TestCompressPrefix(t *testing.T) {
+	testdata := append(text(1<<12), random(1<<10)...)
+	for _, level := range []uint8{GreedyLevel, LazyLevel, OptimalLevel, OfflineLevel} {
+		options := []func(*config){Window(8), Lookahead(4), Level(level)}
+		full := EncodeAll(nil, testdata, options...)
+		for _, size := range []int{0, 1, 2, 3, 100, 1000, len(full) - 1, len(full), len(full) + 10} {
+			dst := make([]byte, size)
+			consumed, written, err := CompressPrefix(dst, testdata, options...)
+			if err != nil {
+				t.Fatalf("Level %d size %d: %v", level, size, err)
+			}
+			if size >= len(full) {
+				if consumed != len(testdata) || !bytes.Equal(full, dst[:written]) {
+					t.Errorf("Level %d size %d: consumed %d bytes writing %d, expected all in %d", level, size, consumed, written, len(full))
+				}
+				continue
+			}
+			// The token which did not fit is at most 13 bits
+			if written > size || size-written > 2 {
+				t.Errorf("Level %d size %d: wrote %d bytes", level, size, written)
+			}
+			decompressed, err := DecodeAll(nil, dst[:written], append(options, Strict())...)
+			if err != nil || !bytes.Equal(testdata[:consumed], decompressed) {
+				t.Errorf("Level %d size %d: expected %d bytes decompressed %d (%v)", level, size, consumed, len(decompressed), err)
+			}
+		}
+	}
+
+	_, _, err := CompressPrefix(make([]byte, 10), testdata, Window(MaxWindow+1))
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected %v, got %v", ErrConfig, err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	inputs := [][]byte{{}, text(1 << 12), random(1 << 12), twoValued(1 << 12), make([]byte, 1<<12)}
+	for _, level := range []uint8{GreedyLevel, LazyLevel, OptimalLevel, OfflineLevel} {
+		for i, testdata := range inputs {
+			options := []func(*config){Window(9), Lookahead(5), Level(level)}
+			expected := len(EncodeAll(nil, testdata, options...))
+			if size := EstimateSize(testdata, options...); size != expected {
+				t.Errorf("Level %d input %d: estimated %d bytes, compressed to %d", level, i, size, expected)
+			}
+
+			e := NewEstimator(options...)
+			e.Write(random(100))
+			e.Reset()
+			// Writes of halving size
+			for p := testdata; len(p) > 0; {
+				n := len(p) - len(p)/2
+				e.Write(p[:n])
+				p = p[n:]
+			}
+			e.Close()
+			if e.Size() != int64(expected) {
+				t.Errorf("Level %d input %d: Estimator measured %d bytes, compressed to %d", level, i, e.Size(), expected)
+			}
+		}
+	}
+}
+
+func BenchmarkEstimateSize(b *testing.B) {
+	testdata := random(1 << 12)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(testdata)))
+	for i := 0; i < b.N; i++ {
+		EstimateSize(testdata)
+	}
+}
+
+func BenchmarkEncodeAll(b *testing.B) {
+	testdata := random(1 << 12)
+	buffer := make([]byte, 0, 2*len(testdata))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(testdata)))
+	for i := 0; i < b.N; i++ {
+		EncodeAll(buffer, testdata)
+	}
+}
+
+func BenchmarkDecodeAll(b *testing.B) {
+	testdata := random(1 << 12)
+	encoded := EncodeAll(nil, testdata)
+	buffer := make([]byte, 0, len(testdata))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(testdata)))
+	for i := 0; i < b.N; i++ {
+		DecodeAll(buffer, encoded)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	testdata := text(1 << 14)
+	for _, window := range []uint8{5, 8, 11} {
+		for _, lookahead := range []uint8{3, 4} {
+			var sizes [MaxLevel + 1]int
+			for level := MinLevel; level <= MaxLevel; level++ {
+				compressed := EncodeAll(nil, testdata, Window(window), Lookahead(lookahead), Level(level))
+				decompressed, err := decompress(compressed, window, lookahead)
+				if err != nil {
+					t.Fatalf("Level %d -w %d -l %d: error decompressing: %v", level, window, lookahead, err)
+				}
+				if !bytes.Equal(testdata, decompressed) {
+					t.Fatalf("Level %d -w %d -l %d: decompressed data differs from original", level, window, lookahead)
+				}
+				sizes[level] = len(compressed)
+			}
+			// With tiny windows the plan is cut short at the end of each buffer, so it can occasionally lose by a byte
+			if window >= 8 && sizes[OptimalLevel] > sizes[GreedyLevel] {
+				t.Errorf("-w %d -l %d: optimal parse %d bytes, greedy %d bytes", window, lookahead, sizes[OptimalLevel], sizes[GreedyLevel])
+			}
+		}
+	}
+}
+
+func TestOfflineLevelNeverLarger(t *testing.T) {
+	inputs := [][]byte{
+		text(1 << 13),
+		random(1 << 12),
+		bytes.Repeat([]byte{0}, 1<<12),
+		append(bytes.Repeat([]byte("ab"), 1<<8), text(1<<10)...),
+	}
+	for i, testdata := range inputs {
+		for window := MinWindow; window <= 12; window++ {
+			for lookahead := MinLookahead; lookahead < window; lookahead++ {
+				greedy := EncodeAll(nil, testdata, Window(window), Lookahead(lookahead))
+				offline := EncodeAll(nil, testdata, Window(window), Lookahead(lookahead), Level(OfflineLevel))
+				if len(offline) > len(greedy) {
+					t.Errorf("Input %d -w %d -l %d: offline %d bytes, greedy %d bytes", i, window, lookahead, len(offline), len(greedy))
+				}
+				decompressed, err := DecodeAll(nil, offline, Window(window), Lookahead(lookahead))
+				if err != nil {
+					t.Fatalf("Input %d -w %d -l %d: error decompressing: %v", i, window, lookahead, err)
+				}
+				if !bytes.Equal(testdata, decompressed) {
+					t.Fatalf("Input %d -w %d -l %d: decompressed data differs from original", i, window, lookahead)
+				}
+			}
+		}
+	}
+}
+
+func TestMaxChainLength(t *testing.T) {
+	testdata := twoValued(1 << 14)
+	for _, chain := range []int{1, 4, 64} {
+		compressed := EncodeAll(nil, testdata, Window(12), Lookahead(4), MaxChainLength(chain))
+		decompressed, err := DecodeAll(nil, compressed, Window(12), Lookahead(4))
+		if err != nil {
+			t.Fatalf("Chain %d: error decompressing: %v", chain, err)
+		}
+		if !bytes.Equal(testdata, decompressed) {
+			t.Fatalf("Chain %d: decompressed data differs from original", chain)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	testdata := text(1 << 12)
+	best, err := Optimize(testdata, Constraints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bestSize := len(EncodeAll(nil, testdata, WithConfig(best)))
+	for _, c := range []Config{{8, 4}, {10, 5}, {12, 6}, {16, 4}} {
+		if size := len(EncodeAll(nil, testdata, WithConfig(c))); size < bestSize {
+			t.Errorf("Optimize chose %v compressing to %d bytes, but %v gives %d", best, bestSize, c, size)
+		}
+	}
+	if best.Window <= 10 {
+		t.Fatalf("Expected a window above 10 without constraints, got %v", best)
+	}
+
+	// Every window up to MaxWindow is searched, and none above it
+	best, err = Optimize(testdata, Constraints{MaxWindow: 10})
+	if err != nil || best.Window > 10 {
+		t.Fatalf("Expected a window of at most 10, got %v (%v)", best, err)
+	}
+	bestSize = len(EncodeAll(nil, testdata, WithConfig(best)))
+	for window := MinWindow; window <= 10; window++ {
+		for lookahead := MinLookahead; lookahead < window; lookahead++ {
+			c := Config{Window: window, Lookahead: lookahead}
+			if size := len(EncodeAll(nil, testdata, WithConfig(c))); size < bestSize {
+				t.Errorf("Optimize chose %v compressing to %d bytes, but %v gives %d", best, bestSize, c, size)
+			}
+		}
+	}
+
+	// Long runs need a long lookahead, but a small window is enough
+	runs := bytes.Repeat(append(make([]byte, 1000), 1), 4)
+	best, err = Optimize(runs, Constraints{MaxDecoderMemory: 1 << 9})
+	if err != nil || best.Window > 9 || best.Lookahead < best.Window-1 {
+		t.Errorf("Expected a long lookahead in at most 512 bytes, got %v (%v)", best, err)
+	}
+
+	_, err = Optimize(testdata, Constraints{MaxDecoderMemory: 8})
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("Expected %v, got %v", ErrConfig, err)
+	}
+}
+
+func BenchmarkEncodeWindows(b *testing.B) {
+	testdata := text(1 << 16)
+	for _, window := range []uint8{8, 12, 14} {
+		b.Run(fmt.Sprintf("w%d", window), func(b *testing.B) {
+			buffer := make([]byte, 0, 2*len(testdata))
+			b.SetBytes(int64(len(testdata)))
+			for i := 0; i < b.N; i++ {
+				EncodeAll(buffer, testdata, Window(window))
+			}
+		})
+	}
+}
+
+// BenchmarkPathological compresses input made of only two byte values, so without a chain limit each search walks
+// through a quarter of the window.
+func BenchmarkPathological(b *testing.B) {
+	testdata := twoValued(1 << 15)
+	for _, window := range []uint8{8, 12, 14} {
+		for _, chain := range []int{0, 16} {
+			b.Run(fmt.Sprintf("w%d-chain%d", window, chain), func(b *testing.B) {
+				buffer := make([]byte, 0, 2*len(testdata))
+				b.SetBytes(int64(len(testdata)))
+				for i := 0; i < b.N; i++ {
+					EncodeAll(buffer, testdata, Window(window), MaxChainLength(chain))
+				}
+			})
+		}
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	dictionary := []byte(`{"device":"sensor","temperature":,"humidity":,"battery":}`)
+	message := []byte(`{"device":"sensor","temperature":21.5,"humidity":40,"battery":97}`)
+	for level := MinLevel; level <= MaxLevel; level++ {
+		without := EncodeAll(nil, message, Window(8), Lookahead(4), Level(level))
+		with := EncodeAll(nil, message, Window(8), Lookahead(4), Level(level), Dictionary(dictionary))
+		if len(with) >= len(without) {
+			t.Errorf("Level %d: %d bytes with dictionary, %d without", level, len(with), len(without))
+		}
+
+		var encoded bytes.Buffer
+		w := NewWriter(&encoded, Window(8), Lookahead(4), Level(level), Dictionary(dictionary))
+		w.Write(message)
+		w.Close()
+		if !bytes.Equal(with, encoded.Bytes()) {
+			t.Errorf("Level %d: NewWriter output differs from EncodeAll output", level)
+		}
+		encoded.Reset()
+		w.Reset(&encoded)
+		w.Write(message)
+		w.Close()
+		if !bytes.Equal(with, encoded.Bytes()) {
+			t.Errorf("Level %d: reset writer output differs from EncodeAll output", level)
+		}
+
+		r := NewReader(bytes.NewReader(with), Window(8), Lookahead(4), Dictionary(dictionary))
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(message, decompressed) {
+			t.Errorf("Level %d: expected %q decompressed %q (%v)", level, message, decompressed, err)
+		}
+		r.Reset(bytes.NewReader(with))
+		decompressed, err = ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(message, decompressed) {
+			t.Errorf("Level %d: reset reader expected %q decompressed %q (%v)", level, message, decompressed, err)
+		}
+		decompressed, err = DecodeAll(nil, with, Window(8), Lookahead(4), Dictionary(dictionary))
+		if err != nil || !bytes.Equal(message, decompressed) {
+			t.Errorf("Level %d: DecodeAll expected %q decompressed %q (%v)", level, message, decompressed, err)
+		}
+	}
+}
+
+func TestDictionaryLongerThanWindow(t *testing.T) {
+	dictionary := text(1 << 10)
+	testdata := append(append([]byte(nil), dictionary[len(dictionary)-100:]...), text(200)...)
+	compressed := EncodeAll(nil, testdata, Window(6), Lookahead(3), Dictionary(dictionary))
+	decompressed, err := DecodeAll(nil, compressed, Window(6), Lookahead(3), Dictionary(dictionary))
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	if !bytes.Equal(testdata, decompressed) {
+		t.Errorf("Decompressed data differs from original")
+	}
+}
+
+// TestGoldenVectors checks compatibility with streams written by the C heatshrink library, which are generated by
+// testdata/golden/generate.sh. The writer should produce the same bytes, and must at least round-trip.
+func TestGoldenVectors(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/golden/inputs/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden inputs")
+	}
+	for _, input := range inputs {
+		original, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for window := MinWindow; window <= 15; window++ {
+			for lookahead := MinLookahead; lookahead < window; lookahead++ {
+				c := Config{Window: window, Lookahead: lookahead}
+				name := filepath.Base(input) + "." + c.String()
+				golden, err := ioutil.ReadFile(filepath.Join("testdata/golden", name))
+				if err != nil {
+					t.Fatalf("%v, run testdata/golden/generate.sh", err)
+				}
+
+				decompressed, err := DecodeAll(nil, golden, WithConfig(c))
+				if err != nil || !bytes.Equal(original, decompressed) {
+					t.Errorf("%s: decompressed %d of %d bytes (%v)", name, len(decompressed), len(original), err)
+				}
+				compressed := EncodeAll(nil, original, WithConfig(c))
+				if bytes.Equal(golden, compressed) {
+					continue
+				}
+				decompressed, err = DecodeAll(nil, compressed, WithConfig(c))
+				if err != nil || !bytes.Equal(original, decompressed) {
+					t.Errorf("%s: differs from the C library and does not round-trip (%v)", name, err)
+				} else {
+					t.Logf("%s: %d bytes, the C library wrote %d", name, len(compressed), len(golden))
+				}
+			}
+		}
+	}
+}
+
 func testRoundTrip(t testing.TB, testdata []byte, window uint8, lookahead uint8) {
 	compressed, err := compress(testdata, window, lookahead)
 	if err != nil {
@@ -150,3 +896,24 @@ func random(n int) []byte {
 	}
 	return b
 }
+
+// text returns n bytes of random words, which compress roughly like natural language
+func text(n int) []byte {
+	words := []string{"the", "quick", "brown", "fox", "jumps", "over", "lazy", "dog", "heatshrink", "window",
+		"lookahead", "back-reference", "literal", "compression", "embedded", "a", "of", "and", "to", "in"}
+	b := make([]byte, 0, n+16)
+	for len(b) < n {
+		b = append(b, words[rand.Intn(len(words))]...)
+		b = append(b, ' ')
+	}
+	return b[:n]
+}
+
+// twoValued returns n bytes randomly chosen from 0 and 1
+func twoValued(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rand.Int31n(2))
+	}
+	return b
+}
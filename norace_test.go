@@ -0,0 +1,5 @@
+//go:build !race
+
+package goheatshrink
+
+const raceEnabled = false
@@ -0,0 +1,60 @@
+package goheatshrink
+
+import "fmt"
+
+// Constraints limits the settings Optimize chooses from
+type Constraints struct {
+	// MaxDecoderMemory is the largest sliding window, in bytes, decoders can allocate, or 0 for no limit. A window of w
+	// needs 2^w bytes.
+	MaxDecoderMemory int
+	// MaxWindow is the largest window to consider, or 0 for MaxWindow. Streams with windows above MaxWindow, up to
+	// MaxExtendedWindow, cannot be decoded by the C heatshrink library.
+	MaxWindow uint8
+}
+
+// Optimize returns the window and lookahead which compress sample the smallest, out of every valid combination allowed
+// by c. Ties go to the smaller window, which needs less decoder memory, and then to the smaller lookahead. The sample
+// should be typical of the data to be compressed with the result.
+//
+// options are used when compressing each candidate, so Level and Dictionary are taken into account. An error wrapping
+// ErrConfig is returned if any option value is invalid, or if c allows no window at all.
+//
+// Every candidate is measured on the whole sample, so Optimize takes much longer than compressing it once. A sample of a
+// few KiB is usually enough.
+func Optimize(sample []byte, c Constraints, options ...func(*config)) (Config, error) {
+	cfg := &config{window: defaultWindow, lookahead: defaultLookahead, level: defaultLevel}
+	for _, option := range options {
+		option(cfg)
+	}
+	err := cfg.check()
+	if err != nil {
+		return Config{}, err
+	}
+	maxWindow := c.MaxWindow
+	if maxWindow == 0 {
+		maxWindow = MaxWindow
+	} else if maxWindow > MaxExtendedWindow {
+		return Config{}, fmt.Errorf("%w: max window %d is above %d", ErrConfig, maxWindow, MaxExtendedWindow)
+	}
+
+	var best Config
+	bestSize := -1
+	candidate := append(options[:len(options):len(options)], nil)
+	for window := MinWindow; window <= maxWindow; window++ {
+		if c.MaxDecoderMemory > 0 && 1<<window > c.MaxDecoderMemory {
+			break
+		}
+		for lookahead := MinLookahead; lookahead < window; lookahead++ {
+			settings := Config{Window: window, Lookahead: lookahead}
+			candidate[len(options)] = WithConfig(settings)
+			size := EstimateSize(sample, candidate...)
+			if bestSize < 0 || size < bestSize {
+				best, bestSize = settings, size
+			}
+		}
+	}
+	if bestSize < 0 {
+		return Config{}, fmt.Errorf("%w: no window fits in %d bytes of decoder memory", ErrConfig, c.MaxDecoderMemory)
+	}
+	return best, nil
+}
@@ -0,0 +1,251 @@
+package goheatshrink
+
+import (
+	"io"
+)
+
+// MinPacketSize is the smallest packet size for NewPacketWriter, which always fits at least one byte of input
+const MinPacketSize = 8
+
+// PacketHistory makes the packets written by NewPacketWriter share one sliding window, so later packets can back-reference
+// data in earlier ones. The packets compress better, but must all be decoded in order by the same PacketReader.
+func PacketHistory() func(*config) {
+	return func(c *config) {
+		c.packetHistory = true
+	}
+}
+
+type packetWriter struct {
+	w    io.Writer
+	size int
+
+	// base is the state after the packets written so far, probe continues it with the pending input to find when a
+	// packet is full, and trial compresses candidate packets
+	base     *writer
+	probe    *writer
+	trial    *writer
+	baseOut  sliceWriter
+	probeOut sliceWriter
+	trialOut sliceWriter
+
+	pending []byte
+	err     error
+}
+
+// NewPacketWriter creates a new WriteResetter compressing the data written to it into packets of at most size bytes,
+// writing each packet to w with a single Write. Each packet holds as much input as fits: input is held back until a full
+// packet is ready, or until Flush or Close writes the rest in as few packets as possible. size is raised to MinPacketSize
+// if smaller.
+//
+// Each packet is a complete heatshrink stream, which can be decompressed on its own by DecodeAll or a PacketReader, unless
+// PacketHistory is given.
+//
+// options modifies the default configuration values to use when compressing. Invalid option values are clamped to the
+// nearest valid value, as by NewWriter. The returned WriteResetter also implements Configurer, returning the settings used
+// to compress each packet.
+func NewPacketWriter(w io.Writer, size int, options ...func(*config)) WriteResetter {
+	if size < MinPacketSize {
+		size = MinPacketSize
+	}
+	pw := &packetWriter{w: w, size: size}
+	pw.base, _ = newWriter(&pw.baseOut, options...)
+	pw.probe, _ = newWriter(&pw.probeOut, options...)
+	pw.trial, _ = newWriter(&pw.trialOut, options...)
+	return pw
+}
+
+func (pw *packetWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	pw.pending = append(pw.pending, p...)
+	_, err := pw.probe.Write(p)
+	if err != nil {
+		pw.err = err
+		return 0, err
+	}
+	// Once the output so far fills a packet, not all the pending input fits in one
+	for len(pw.probeOut.buf) >= pw.size {
+		err = pw.writePacket()
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes all pending input in as few packets as possible
+func (pw *packetWriter) Flush() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	for len(pw.pending) > 0 {
+		err := pw.writePacket()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pw *packetWriter) Close() error {
+	return pw.Flush()
+}
+
+func (pw *packetWriter) Reset(w io.Writer) {
+	pw.w = w
+	pw.base.Reset(&pw.baseOut)
+	pw.pending = pw.pending[:0]
+	pw.err = nil
+	pw.restartProbe()
+}
+
+// Config returns the settings used to compress each packet
+func (pw *packetWriter) Config() Config {
+	return pw.base.Config()
+}
+
+// writePacket writes a packet holding the longest prefix of the pending input that fits
+func (pw *packetWriter) writePacket() error {
+	n := len(pw.pending)
+	size, err := pw.compress(n)
+	if err != nil {
+		pw.err = err
+		return err
+	}
+	if size > pw.size {
+		// Binary search for the longest prefix that fits, between lo which does and hi which does not
+		lo, hi := 0, n
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			size, err = pw.compress(mid)
+			if err != nil {
+				pw.err = err
+				return err
+			}
+			if size <= pw.size {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		n = lo
+		if n == 0 {
+			n = 1
+		}
+		if size, err = pw.compress(n); err != nil {
+			pw.err = err
+			return err
+		}
+	}
+
+	_, err = pw.w.Write(pw.trialOut.buf)
+	if err != nil {
+		pw.err = err
+		return err
+	}
+	if pw.base.packetHistory {
+		pw.base.copyState(pw.trial, &pw.baseOut)
+	}
+	pw.pending = pw.pending[:copy(pw.pending, pw.pending[n:])]
+	pw.restartProbe()
+	return pw.err
+}
+
+// compress compresses the first n bytes of pending input as the next packet into trialOut, returning its size
+func (pw *packetWriter) compress(n int) (int, error) {
+	pw.trialOut.buf = pw.trialOut.buf[:0]
+	pw.trial.copyState(pw.base, &pw.trialOut)
+	_, err := pw.trial.Write(pw.pending[:n])
+	if err != nil {
+		return 0, err
+	}
+	if pw.base.packetHistory {
+		err = pw.trial.Flush()
+	} else {
+		err = pw.trial.Close()
+	}
+	return len(pw.trialOut.buf), err
+}
+
+// restartProbe compresses the pending input again from the base state
+func (pw *packetWriter) restartProbe() {
+	pw.probeOut.buf = pw.probeOut.buf[:0]
+	pw.probe.copyState(pw.base, &pw.probeOut)
+	_, err := pw.probe.Write(pw.pending)
+	if err != nil {
+		pw.err = err
+	}
+}
+
+// copyState makes w continue exactly as src would, writing to out. w's buffers are reused when big enough.
+func (w *writer) copyState(src *writer, out inner) {
+	buffer, index, head, offline := w.buffer, w.index, w.head, w.offline
+	planCost, planLength, planPosition := w.planCost, w.planLength, w.planPosition
+	*w = *src
+	w.buffer = append(buffer[:0], src.buffer...)
+	w.index = append(index[:0], src.index...)
+	w.head = append(head[:0], src.head...)
+	w.offline = append(offline[:0], src.offline...)
+	w.planCost = append(planCost[:0], src.planCost...)
+	w.planLength = append(planLength[:0], src.planLength...)
+	w.planPosition = append(planPosition[:0], src.planPosition...)
+	w.inner = out
+	w.buffered = nil
+}
+
+// PacketReader decompresses the packets written by NewPacketWriter, one at a time.
+type PacketReader interface {
+	// ReadPacket decompresses packet and appends the result to dst, returning the updated slice. With PacketHistory,
+	// packets must be given in the order they were written, and once an error is returned the PacketReader must be Reset.
+	ReadPacket(dst, packet []byte) ([]byte, error)
+	// Reset discards the window history, to start decompressing a new series of packets
+	Reset()
+	// Configurer returns the settings used to decompress
+	Configurer
+}
+
+type packetReader struct {
+	inner *reader
+}
+
+// NewPacketReader creates a new PacketReader decompressing packets written by NewPacketWriter.
+//
+// options modifies the default configuration values to use when decompressing, which must match those used to compress,
+// including PacketHistory. Invalid option values are clamped to the nearest valid value, as by NewReader. With MaxOutput,
+// each packet is limited to that many bytes.
+func NewPacketReader(options ...func(*config)) PacketReader {
+	r, _ := newReader(nil, options...)
+	return &packetReader{inner: r}
+}
+
+func (pr *packetReader) ReadPacket(dst, packet []byte) ([]byte, error) {
+	r := pr.inner
+	if r.err != nil {
+		return dst, r.err
+	}
+	if !r.packetHistory {
+		r.Reset(nil)
+	}
+	// Strict checks back-references against all the output so far, so only the MaxOutput count restarts
+	r.inputOffset = 0
+	r.packetStart = r.outputOffset
+	dst, err := r.decodeAll(dst, packet)
+	r.buffer = nil
+	if err == nil && r.packetHistory && (r.state != decodeStateTagBit || r.bitIndex != 0) {
+		// The next packet would continue part way through a symbol
+		err = r.corrupt(ErrTruncated)
+	}
+	if err != nil {
+		r.err = err
+	}
+	return dst, err
+}
+
+func (pr *packetReader) Reset() {
+	pr.inner.Reset(nil)
+}
+
+func (pr *packetReader) Config() Config {
+	return pr.inner.Config()
+}
@@ -0,0 +1,125 @@
+package goheatshrink
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// packets records each Write as a packet
+type packets [][]byte
+
+func (p *packets) Write(b []byte) (int, error) {
+	*p = append(*p, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestPacketWriter(t *testing.T) {
+	testdata := text(1 << 12)
+	for _, size := range []int{MinPacketSize, 20, 244} {
+		for _, level := range []uint8{GreedyLevel, OptimalLevel} {
+			var sizes [2]int
+			for i, history := range []bool{false, true} {
+				options := []func(*config){Window(9), Lookahead(5), Level(level)}
+				if history {
+					options = append(options, PacketHistory())
+				}
+				var sent packets
+				w := NewPacketWriter(&sent, size, options...)
+				for p := testdata; len(p) > 0; {
+					n := 1 + rand.Intn(100)
+					if n > len(p) {
+						n = len(p)
+					}
+					w.Write(p[:n])
+					p = p[n:]
+				}
+				err := w.Close()
+				if err != nil {
+					t.Fatalf("Size %d level %d: error compressing: %v", size, level, err)
+				}
+
+				r := NewPacketReader(options...)
+				var decompressed []byte
+				for j, packet := range sent {
+					if len(packet) > size {
+						t.Errorf("Size %d level %d: packet %d has %d bytes", size, level, j, len(packet))
+					}
+					start := len(decompressed)
+					decompressed, err = r.ReadPacket(decompressed, packet)
+					if err != nil {
+						t.Fatalf("Size %d level %d: error decompressing packet %d: %v", size, level, j, err)
+					}
+					// Packets other than the last are full, so one more byte of input does not fit
+					if end := len(decompressed); !history && j < len(sent)-1 {
+						if n := len(EncodeAll(nil, testdata[start:end+1], options...)); n <= size {
+							t.Errorf("Size %d level %d: packet %d of %d bytes could hold another byte in %d", size, level, j, len(packet), n)
+						}
+					}
+					sizes[i] += len(packet)
+				}
+				if !bytes.Equal(testdata, decompressed) {
+					t.Errorf("Size %d level %d: decompressed data differs from original", size, level)
+				}
+			}
+			if sizes[1] >= sizes[0] {
+				t.Errorf("Size %d level %d: %d bytes with PacketHistory, %d without", size, level, sizes[1], sizes[0])
+			}
+		}
+	}
+}
+
+func TestPacketWriterFlush(t *testing.T) {
+	var sent packets
+	w := NewPacketWriter(&sent, 244, PacketHistory())
+	r := NewPacketReader(PacketHistory())
+	message := []byte("temperature=21.5 humidity=40")
+	for i := 0; i < 3; i++ {
+		w.Write(message)
+		err := w.Flush()
+		if err != nil || len(sent) != i+1 {
+			t.Fatalf("Expected %d packets after Flush, got %d (%v)", i+1, len(sent), err)
+		}
+		decompressed, err := r.ReadPacket(nil, sent[i])
+		if err != nil || !bytes.Equal(message, decompressed) {
+			t.Fatalf("Packet %d: expected %q decompressed %q (%v)", i, message, decompressed, err)
+		}
+	}
+	if len(sent[1]) >= len(sent[0]) {
+		t.Errorf("Second packet not compressed against the first: %d bytes after %d", len(sent[1]), len(sent[0]))
+	}
+
+	// After a lost packet the history differs, and the reader must start again with the writer
+	sent = nil
+	w.Reset(&sent)
+	r.Reset()
+	w.Write(message)
+	w.Flush()
+	decompressed, err := r.ReadPacket(nil, sent[0])
+	if err != nil || !bytes.Equal(message, decompressed) {
+		t.Errorf("After Reset: expected %q decompressed %q (%v)", message, decompressed, err)
+	}
+}
+
+func TestPacketHistoryStrict(t *testing.T) {
+	var sent packets
+	options := []func(*config){PacketHistory(), Strict()}
+	w := NewPacketWriter(&sent, 244, options...)
+	// Strict checks back-references into earlier packets, while MaxOutput still limits each packet
+	r := NewPacketReader(append(options, MaxOutput(64))...)
+	message := []byte("temperature=21.5 humidity=40")
+	for i := 0; i < 4; i++ {
+		w.Write(message)
+		err := w.Flush()
+		if err != nil {
+			t.Fatalf("Packet %d: error compressing: %v", i, err)
+		}
+		decompressed, err := r.ReadPacket(nil, sent[i])
+		if err != nil || !bytes.Equal(message, decompressed) {
+			t.Fatalf("Packet %d: expected %q decompressed %q (%v)", i, message, decompressed, err)
+		}
+	}
+	if len(sent[1]) >= len(sent[0]) {
+		t.Errorf("Second packet not compressed against the first: %d bytes after %d", len(sent[1]), len(sent[0]))
+	}
+}
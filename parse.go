@@ -0,0 +1,221 @@
+package goheatshrink
+
+import "errors"
+
+const literalCost = 9
+
+// lazyMatch returns the longest match at msi, unless the next position has a longer match, in which case it returns
+// matchNotFound so that a literal is emitted and the longer match is taken on the next step.
+func (w *writer) lazyMatch(msi int) (int, int) {
+	var matchPos, matchLength int
+	if w.lazyIndex == msi {
+		matchPos, matchLength = w.lazyPosition, w.lazyLength
+	} else {
+		matchPos, matchLength = w.longestMatchAt(msi)
+	}
+	if matchPos == matchNotFound || matchLength == w.maxMatchLength() || msi+1 > w.lastSearchIndex() {
+		return matchPos, matchLength
+	}
+	nextPos, nextLength := w.longestMatchAt(msi + 1)
+	w.lazyIndex, w.lazyPosition, w.lazyLength = msi+1, nextPos, nextLength
+	if nextLength > matchLength {
+		return matchNotFound, 0
+	}
+	return matchPos, matchLength
+}
+
+// plannedMatch returns the match chosen for msi by planParse, planning the rest of the buffered input if needed.
+func (w *writer) plannedMatch(msi int) (int, int) {
+	if msi < w.planStart || msi >= w.planEnd {
+		w.planParse(msi)
+	}
+	if w.planLength[msi] == 0 {
+		return matchNotFound, 0
+	}
+	return w.planPosition[msi], w.planLength[msi]
+}
+
+// planParse finds the sequence of literals and back-references with the fewest bits covering the buffered input from msi,
+// by working backwards from the end and choosing at each position between a literal and every usable length of the longest
+// match there. Only the plan up to lastSearchIndex is used: the rest is planned again once more input has been buffered,
+// so the cost of each plan is bounded by the input buffer size.
+func (w *writer) planParse(msi int) {
+	ibs := w.getInputBufferSize()
+	if len(w.planCost) < ibs+1 {
+		w.planCost = make([]int, ibs+1)
+		w.planLength = make([]int, ibs+1)
+		w.planPosition = make([]int, ibs+1)
+	}
+	costFrom := func(i int) int {
+		if i >= w.inputSize {
+			return 0
+		}
+		return w.planCost[i]
+	}
+	backRefCost := 1 + int(w.window) + int(w.lookahead)
+	// findLongestMatch only returns matches longer than this, shorter back-references would not save anything
+	minLength := backRefCost/8 + 1
+	for i := w.inputSize - 1; i >= msi; i-- {
+		bestCost := literalCost + costFrom(i+1)
+		bestLength := 0
+		pos, length := w.longestMatchAt(i)
+		for l := minLength; l <= length; l++ {
+			cost := backRefCost + costFrom(i+l)
+			if cost <= bestCost {
+				bestCost = cost
+				bestLength = l
+			}
+		}
+		w.planCost[i] = bestCost
+		w.planLength[i] = bestLength
+		w.planPosition[i] = pos
+	}
+	w.planStart = msi
+	w.planEnd = w.lastSearchIndex() + 1
+}
+
+// invalidateParse discards any lazy match or plan, which refer to positions in the buffer that are about to change.
+func (w *writer) invalidateParse() {
+	w.lazyIndex = matchNotFound
+	w.planStart = 0
+	w.planEnd = 0
+}
+
+// bufferOffline holds p until Flush or Close, after the history of previously encoded input.
+func (w *writer) bufferOffline(p []byte) (int, error) {
+	if w.isFinishing() {
+		return 0, errors.New("sinking while finishing")
+	}
+	if len(w.offline) == 0 {
+		// Like the backlog of buffer, the history starts out as zeros followed by the dictionary
+		w.offline = append(w.offline, make([]byte, w.getInputBufferSize())...)
+		w.loadDictionary(w.offline)
+	}
+	w.offline = append(w.offline, p...)
+	return len(p), nil
+}
+
+// encodeOffline writes the cheapest sequence of literals and back-references for all input buffered by bufferOffline,
+// found as the shortest path through the input where each literal costs 9 bits and each back-reference 1+window+lookahead.
+// Every match the greedy search could take is considered, so the result is never larger than the greedy encoding
+// (unless MaxChainLength cuts the search short).
+func (w *writer) encodeOffline() error {
+	ibs := w.getInputBufferSize()
+	data := w.offline
+	if len(data) <= ibs {
+		return nil
+	}
+	n := len(data)
+	windowLength := 1 << w.window
+	lookaheadLength := w.maxMatchLength()
+	backRefCost := 1 + int(w.window) + int(w.lookahead)
+	minLength := backRefCost/8 + 1
+	// With Strict, back-references may not reach the initial zeros before the history
+	first := 0
+	if w.strict {
+		first = ibs - w.history
+	}
+
+	// Chains of earlier positions with the same hash of their first two bytes, as built by doIndexing
+	bits := hashBits(w.window)
+	head := make([]int32, 1<<bits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	for i := 0; i < n-1; i++ {
+		h := hash2(data[i], data[i+1], bits)
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+	prev[n-1] = -1
+
+	cost := make([]int, n+1)
+	length := make([]int, n)
+	offset := make([]int, n)
+	for i := n - 1; i >= ibs; i-- {
+		cost[i] = literalCost + cost[i+1]
+		maxPossible := lookaheadLength
+		if n-i < maxPossible {
+			maxPossible = n - i
+		}
+		start := i - windowLength
+		if start < first {
+			start = first
+		}
+		matchOffset, matchLength := longestChainMatch(data, prev, start, i, maxPossible, w.maxChainLength)
+		for l := minLength; l <= matchLength; l++ {
+			c := backRefCost + cost[i+l]
+			if c <= cost[i] {
+				cost[i] = c
+				length[i] = l
+				offset[i] = matchOffset
+			}
+		}
+	}
+
+	for i := ibs; i < n; {
+		if length[i] == 0 {
+			err := w.addTagBit(heatshrinkLiteralMarker)
+			if err == nil {
+				err = w.pushBits(8, data[i])
+			}
+			if err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		err := w.addTagBit(heatshrinkBackrefMarker)
+		if err == nil {
+			err = w.pushWideBits(w.window, offset[i]-1)
+		}
+		if err == nil {
+			err = w.pushWideBits(w.lookahead, length[i]-1)
+		}
+		if err != nil {
+			return err
+		}
+		i += length[i]
+	}
+
+	// Keep the end of the input as history for back-references from input buffered after a Flush
+	w.offline = w.offline[:copy(w.offline, data[n-ibs:])]
+	w.history += n - ibs
+	if w.history > ibs {
+		w.history = ibs
+	}
+	return nil
+}
+
+// longestChainMatch returns the offset and length of the longest match for data[end:] starting at or after start, following
+// the chain of positions in prev for at most maxChain steps (if maxChain > 0).
+func longestChainMatch(data []byte, prev []int32, start int, end int, max int, maxChain int) (int, int) {
+	matchLength := 0
+	matchIndex := matchNotFound
+	chain := 0
+	for pos := int(prev[end]); pos >= start && pos >= 0; pos = int(prev[pos]) {
+		if maxChain > 0 && chain == maxChain {
+			break
+		}
+		chain++
+		if data[pos+matchLength] != data[end+matchLength] {
+			continue
+		}
+		l := 0
+		for l < max && data[pos+l] == data[end+l] {
+			l++
+		}
+		if l > matchLength {
+			matchLength = l
+			matchIndex = pos
+			if l == max {
+				break
+			}
+		}
+	}
+	if matchIndex == matchNotFound {
+		return matchNotFound, 0
+	}
+	return end - matchIndex, matchLength
+}
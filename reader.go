@@ -2,7 +2,8 @@ package goheatshrink
 
 import (
 	"io"
-	"log"
+	"math/bits"
+	"strconv"
 )
 
 // ReadResetter groups an io.Reader with a Reset method, which can switch to a new underlying io.Reader.
@@ -34,6 +35,19 @@ type reader struct {
 
 	outputCount        int
 	outputBackRefIndex int
+
+	reference       io.ReaderAt
+	referenceCursor int
+	fromReference   bool
+	err             error
+
+	// Bytes of input loaded into current, and bytes of output produced, for CorruptInputError and MaxOutput
+	inputOffset  int64
+	outputOffset int64
+	// Value of outputOffset at the start of the current packet, from which MaxOutput is counted
+	packetStart int64
+	// Output buffer for checking whether there is more output than MaxOutput
+	probe [1]byte
 }
 
 type decodeState int
@@ -46,12 +60,49 @@ const (
 	decodeStateBackRefCountMSB
 	decodeStateBackRefCountLSB
 	decodeStateYieldBackRef
+	decodeStateBackRefSource
 )
 
+var decodeStateNames = [...]string{
+	decodeStateTagBit:          "TagBit",
+	decodeStateYieldLiteral:    "YieldLiteral",
+	decodeStateBackRefIndexMSB: "BackRefIndexMSB",
+	decodeStateBackRefIndexLSB: "BackRefIndexLSB",
+	decodeStateBackRefCountMSB: "BackRefCountMSB",
+	decodeStateBackRefCountLSB: "BackRefCountLSB",
+	decodeStateYieldBackRef:    "YieldBackRef",
+	decodeStateBackRefSource:   "BackRefSource",
+}
+
+func (s decodeState) String() string {
+	if s >= 0 && int(s) < len(decodeStateNames) {
+		return decodeStateNames[s]
+	}
+	return "decodeState(" + strconv.Itoa(int(s)) + ")"
+}
+
 // NewReaderConfig creates a new ReadResetter reading the given io.Reader.
 //
 // options modifies the default configuration values to use when decompressing
+//
+// Invalid option values are clamped to the nearest valid value. Use NewReaderOptions to have them reported instead.
+// The returned ReadResetter also implements Configurer, returning the settings used to decompress.
 func NewReader(r io.Reader, options ...func(*config)) ReadResetter {
+	hr, _ := newReader(r, options...)
+	return hr
+}
+
+// NewReaderOptions is like NewReader, but returns an error wrapping ErrConfig if any option value is invalid. The returned
+// ReadResetter also implements Configurer.
+func NewReaderOptions(r io.Reader, options ...func(*config)) (ReadResetter, error) {
+	hr, err := newReader(r, options...)
+	if err != nil {
+		return nil, err
+	}
+	return hr, nil
+}
+
+func newReader(r io.Reader, options ...func(*config)) (*reader, error) {
 	hr := &reader{
 		config: &config{window:defaultWindow, lookahead:defaultLookahead},
 		inner:        r,
@@ -60,32 +111,79 @@ func NewReader(r io.Reader, options ...func(*config)) ReadResetter {
 	for _, option := range options {
 		option(hr.config)
 	}
+	err := hr.check()
 	hr.windowBuffer = make([]byte, 1<<hr.window)
-	hr.inputBuffer = make([]byte, 1<<hr.window)
-	return hr;
+	inputBufferSize := 1 << hr.window
+	if inputBufferSize > 1<<MaxWindow {
+		inputBufferSize = 1 << MaxWindow
+	}
+	hr.inputBuffer = make([]byte, inputBufferSize)
+	hr.loadDictionary()
+	return hr, err
 }
 
 func (r *reader) Read(out []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
 	if len(out) == 0 {
 		return 0, nil
 	}
+	if r.maxOutput > 0 && r.limitedOutput() == r.maxOutput {
+		// Only an error if the stream has more output
+		n, err := r.read(r.probe[:])
+		if n > 0 {
+			r.err = ErrOutputLimitExceeded
+			return 0, r.err
+		}
+		return 0, err
+	}
+	return r.read(r.limitOutput(out))
+}
+
+// limitedOutput returns the bytes of output counted against MaxOutput
+func (r *reader) limitedOutput() int64 {
+	return r.outputOffset - r.packetStart
+}
+
+// limitOutput shortens out to the output remaining before MaxOutput is reached
+func (r *reader) limitOutput(out []byte) []byte {
+	if remaining := r.maxOutput - r.limitedOutput(); r.maxOutput > 0 && remaining < int64(len(out)) {
+		return out[:remaining]
+	}
+	return out
+}
+
+func (r *reader) read(out []byte) (int, error) {
 	var in []byte
 	if r.inputSize > 0 {
-		// Still have leftover bytes from last read
+		// Still have leftover bytes from last read, too few for the next field
+		r.inputSize = copy(r.inputBuffer, r.inputBuffer[r.inputIndex:r.inputSize])
+		r.inputIndex = 0
 		in = r.inputBuffer[r.inputSize:]
 	} else {
 		in = r.inputBuffer
 	}
 	count, err := r.inner.Read(in)
 	r.inputSize += count
-	if r.inputSize > 0 {
-		return r.decodeRead(r.inputBuffer[:r.inputSize], out)
-	} else if err != nil {
+	if r.inputSize > 0 || r.state == decodeStateYieldBackRef {
+		// Either more input, or the rest of a back-reference that did not fit in the last Read
+		n, decodeErr := r.decodeRead(r.inputBuffer[:r.inputSize], out)
+		if n > 0 || decodeErr != nil || err == nil {
+			return n, decodeErr
+		}
+		// The input ended part way through a field
+	}
+	if err != nil {
 		if err == io.EOF {
 			if r.finish() {
+				err = r.checkEnd()
+				if err != nil {
+					return 0, err
+				}
 				return 0, io.EOF
 			}
-			return 0, ErrTruncated
+			return 0, r.corrupt(ErrTruncated)
 		}
 		return 0, err
 	}
@@ -110,7 +208,13 @@ func (r *reader) Reset(new io.Reader) {
 	r.current = 0x0
 	r.outputCount = 0
 	r.outputBackRefIndex = 0
-	r.headIndex = 0
+	r.referenceCursor = 0
+	r.fromReference = false
+	r.err = nil
+	r.inputOffset = 0
+	r.outputOffset = 0
+	r.packetStart = 0
+	r.loadDictionary()
 	r.inner = new
 }
 
@@ -126,7 +230,6 @@ func (o *output) push(b byte) {
 }
 
 func (r *reader) decodeRead(in []byte, out []byte) (int, error) {
-	totalout := 0
 	r.buffer = in
 	r.inputSize = len(in)
 
@@ -135,19 +238,12 @@ func (r *reader) decodeRead(in []byte, out []byte) (int, error) {
 		size:  len(out),
 		index: 0,
 	}
-	for {
-		outputSize, err := r.poll(o)
-		totalout += outputSize
-		if err == errOutputBufferFull {
-			return totalout, nil
-		} else if err != nil {
-			return totalout, err
-		}
-		if r.finish() {
-			return totalout, nil
-		}
+	// poll only stops when the output is full, or more input is needed
+	outputSize, err := r.poll(o)
+	if err == errOutputBufferFull {
+		return outputSize, nil
 	}
-	return totalout, ErrTruncated
+	return outputSize, err
 }
 
 func (r *reader) poll(o *output) (int, error) {
@@ -171,11 +267,16 @@ func (r *reader) poll(o *output) (int, error) {
 			r.state = r.stateBackRefCountLSB()
 		case decodeStateYieldBackRef:
 			r.state = r.stateYieldBackRef(o)
+		case decodeStateBackRefSource:
+			r.state = r.stateBackRefSource()
 		default:
-			log.Fatal("Unknown state: %v", state)
+			r.err = &StateError{Machine: "reader", State: int(state)}
+		}
+		if r.err != nil {
+			return o.index, r.err
 		}
 		if r.state == state {
-			if o.index == cap(o.buf) {
+			if o.index == o.size {
 				return o.index, errOutputBufferFull
 			}
 			return o.index, nil
@@ -191,31 +292,49 @@ func (r *reader) stateTagBit() decodeState {
 	if bits > 0 {
 		return decodeStateYieldLiteral
 	}
-	if r.window > 8 {
+	if r.reference != nil {
+		return decodeStateBackRefSource
+	}
+	return r.backRefIndexState()
+}
+
+func (r *reader) backRefIndexState() decodeState {
+	if r.indexBits() > 8 {
 		return decodeStateBackRefIndexMSB
 	}
 	r.outputBackRefIndex = 0
 	return decodeStateBackRefIndexLSB
 }
 
+// stateBackRefSource reads the bit of a delta stream back-reference selecting between the window and the old image
+func (r *reader) stateBackRefSource() decodeState {
+	bits, err := r.getBits(1)
+	if err == errNoBitsAvailable {
+		return decodeStateBackRefSource
+	}
+	r.fromReference = bits > 0
+	return r.backRefIndexState()
+}
+
 func (r *reader) stateYieldLiteral(o *output) decodeState {
 	if o.index < o.size {
 		bits, err := r.getBits(8)
 		if err == errNoBitsAvailable {
 			return decodeStateYieldLiteral
 		}
-		var mask uint16 = (1 << r.window) - 1
+		mask := (1 << r.window) - 1
 		c := byte(bits & 0xFF)
-		r.windowBuffer[uint16(r.headIndex)&mask] = c
+		r.windowBuffer[r.headIndex&mask] = c
 		r.headIndex++
 		o.push(c)
+		r.outputOffset++
 		return decodeStateTagBit
 	}
 	return decodeStateYieldLiteral
 }
 
 func (r *reader) stateBackRefIndexMSB() decodeState {
-	bitCount := r.window
+	bitCount := r.indexBits()
 	bits, err := r.getBits(bitCount - 8)
 	if err == errNoBitsAvailable {
 		return decodeStateBackRefIndexMSB
@@ -225,8 +344,8 @@ func (r *reader) stateBackRefIndexMSB() decodeState {
 }
 
 func (r *reader) stateBackRefIndexLSB() decodeState {
-	bitCount := r.window
-	var bits uint16
+	bitCount := r.indexBits()
+	var bits uint32
 	var err error
 	if bitCount < 8 {
 		bits, err = r.getBits(bitCount)
@@ -258,7 +377,7 @@ func (r *reader) stateBackRefCountMSB() decodeState {
 
 func (r *reader) stateBackRefCountLSB() decodeState {
 	backRefBitCount := r.lookahead
-	var bits uint16
+	var bits uint32
 	var err error
 	if backRefBitCount < 8 {
 		bits, err = r.getBits(backRefBitCount)
@@ -270,6 +389,26 @@ func (r *reader) stateBackRefCountLSB() decodeState {
 	}
 	r.outputCount |= int(bits)
 	r.outputCount++
+	if r.fromReference {
+		// The index field holds the offset from the reference cursor plus 2^(deltaOffsetBits-1)
+		r.referenceCursor += r.outputBackRefIndex - 1 - 1<<(deltaOffsetBits-1)
+		if r.referenceCursor < 0 {
+			r.err = r.corrupt(ErrReference)
+		}
+		return decodeStateYieldBackRef
+	}
+	if r.outputBackRefIndex == 1 && r.outputCount == 1 {
+		// Sync marker written by Flush, the rest of the current byte is padding
+		if r.strict && r.bitIndex != 0 && r.current&(r.bitIndex<<1-1) != 0 {
+			r.err = r.corrupt(ErrPadding)
+		}
+		r.outputCount = 0
+		r.bitIndex = 0
+		return decodeStateTagBit
+	}
+	if r.strict && r.outputBackRefIndex > int(r.outputOffset)+len(r.dictionaryWindow()) {
+		r.err = r.corrupt(ErrBackReference)
+	}
 	return decodeStateYieldBackRef
 }
 
@@ -280,6 +419,9 @@ func (r *reader) stateYieldBackRef(o *output) decodeState {
 			count = r.outputCount
 		}
 
+		if r.fromReference {
+			return r.yieldReference(o, count)
+		}
 		mask := (1 << r.window) - 1
 		negOffset := r.outputBackRefIndex
 		for i := 0; i < count; i++ {
@@ -288,6 +430,7 @@ func (r *reader) stateYieldBackRef(o *output) decodeState {
 			r.windowBuffer[r.headIndex&mask] = c
 			r.headIndex++
 		}
+		r.outputOffset += int64(count)
 		r.outputCount -= count
 		if r.outputCount == 0 {
 			return decodeStateTagBit
@@ -296,16 +439,16 @@ func (r *reader) stateYieldBackRef(o *output) decodeState {
 	return decodeStateYieldBackRef
 }
 
-func (r *reader) getBits(count uint8) (uint16, error) {
-	var accumulator uint16
+func (r *reader) getBits(count uint8) (uint32, error) {
+	var accumulator uint32
 
-	if count > 15 {
-		return 0, errNoBitsAvailable
+	// Only take bits if all count are available, so none are lost when the input runs out part way
+	available := bits.Len8(r.bitIndex)
+	if r.inputSize > 0 {
+		available += 8 * (r.inputSize - r.inputIndex)
 	}
-	if r.inputSize == 0 {
-		if r.bitIndex < (1 << (count - 1)) {
-			return 0, errNoBitsAvailable
-		}
+	if count > 32 || available < int(count) {
+		return 0, errNoBitsAvailable
 	}
 	var i uint8
 	for i = 0; i < count; i++ {
@@ -315,6 +458,7 @@ func (r *reader) getBits(count uint8) (uint16, error) {
 			}
 			r.current = r.buffer[r.inputIndex]
 			r.inputIndex++
+			r.inputOffset++
 			if r.inputIndex == r.inputSize {
 				r.inputIndex = 0
 				r.inputSize = 0
@@ -330,9 +474,35 @@ func (r *reader) getBits(count uint8) (uint16, error) {
 	return accumulator, nil
 }
 
+// checkEnd returns an error wrapping ErrPadding if the input has ended on something other than zero padding, with Strict.
+// The padding after the last symbol may have been read as the start of a back-reference.
+func (r *reader) checkEnd() error {
+	if !r.strict {
+		return nil
+	}
+	valid := true
+	switch r.state {
+	case decodeStateYieldLiteral:
+		valid = false
+	case decodeStateBackRefIndexMSB:
+		valid = !r.fromReference
+	case decodeStateBackRefIndexLSB:
+		valid = !r.fromReference && r.outputBackRefIndex == 0
+	case decodeStateBackRefCountMSB, decodeStateBackRefCountLSB:
+		valid = !r.fromReference && r.outputBackRefIndex == 1 && r.outputCount == 0
+	}
+	if r.bitIndex != 0 && r.current&(r.bitIndex<<1-1) != 0 {
+		valid = false
+	}
+	if !valid {
+		return r.corrupt(ErrPadding)
+	}
+	return nil
+}
+
 func (r *reader) finish() bool {
 	switch r.state {
-	case decodeStateTagBit, decodeStateBackRefIndexLSB, decodeStateBackRefIndexMSB, decodeStateBackRefCountLSB, decodeStateBackRefCountMSB, decodeStateYieldLiteral:
+	case decodeStateTagBit, decodeStateBackRefSource, decodeStateBackRefIndexLSB, decodeStateBackRefIndexMSB, decodeStateBackRefCountLSB, decodeStateBackRefCountMSB, decodeStateYieldLiteral:
 		if r.inputSize == 0 {
 			return true
 		}
@@ -342,3 +512,19 @@ func (r *reader) finish() bool {
 	}
 	return false
 }
+
+// corrupt returns a CorruptInputError for err at the current position
+func (r *reader) corrupt(err error) error {
+	e := &CorruptInputError{
+		Offset: r.inputOffset,
+		State:  r.state.String(),
+		Output: r.outputOffset,
+		Err:    err,
+	}
+	if r.bitIndex != 0 {
+		// Part way through the last byte loaded
+		e.Offset--
+		e.Bit = 8 - bits.Len8(r.bitIndex)
+	}
+	return e
+}
@@ -0,0 +1,231 @@
+package goheatshrink
+
+import "sync"
+
+var (
+	writerPool sync.Pool
+	readerPool sync.Pool
+)
+
+// EncodeAll compresses src and appends the result to dst, returning the updated slice.
+//
+// options modifies the default configuration values to use when compressing
+//
+// The encoder state is pooled between calls, so in steady state EncodeAll does not allocate unless dst needs to grow.
+func EncodeAll(dst, src []byte, options ...func(*config)) []byte {
+	e := getEncoder(options)
+	w := &e.writer
+	e.out.buf = dst
+	w.Reset(&e.out)
+	// Writes to a sliceWriter never fail
+	w.Write(src)
+	w.Close()
+	dst = e.out.buf
+
+	e.out.buf = nil
+	writerPool.Put(e)
+	return dst
+}
+
+// EstimateSize returns the length of the output EncodeAll would produce for src, without producing it.
+//
+// options modifies the default configuration values to use when compressing
+func EstimateSize(src []byte, options ...func(*config)) int {
+	e := getEncoder(options)
+	w := &e.writer
+	w.Reset(&e.out)
+	w.counting = true
+	w.Write(src)
+	w.Close()
+	size := int(w.countedSize())
+
+	w.counting = false
+	writerPool.Put(e)
+	return size
+}
+
+// sliceEncoder is a writer which appends its output to a slice, pooled by EncodeAll and EstimateSize
+type sliceEncoder struct {
+	writer
+	out sliceWriter
+}
+
+// getEncoder returns a pooled sliceEncoder configured by options
+func getEncoder(options []func(*config)) *sliceEncoder {
+	e, _ := writerPool.Get().(*sliceEncoder)
+	if e == nil {
+		e = &sliceEncoder{writer: writer{config: &config{}}}
+	}
+	w := &e.writer
+	*w.config = config{window: defaultWindow, lookahead: defaultLookahead, level: defaultLevel}
+	for _, option := range options {
+		option(w.config)
+	}
+	w.check()
+	w.allocate()
+	return e
+}
+
+// DecodeAll decompresses src and appends the result to dst, returning the updated slice.
+//
+// options modifies the default configuration values to use when decompressing. An error wrapping ErrConfig is returned
+// if any option value is invalid. With MaxOutput, at most that many bytes are appended to dst.
+//
+// The decoder state is pooled between calls, so in steady state DecodeAll does not allocate unless dst needs to grow.
+func DecodeAll(dst, src []byte, options ...func(*config)) ([]byte, error) {
+	r, _ := readerPool.Get().(*reader)
+	if r == nil {
+		r = &reader{config: &config{}}
+	}
+	*r.config = config{window: defaultWindow, lookahead: defaultLookahead}
+	for _, option := range options {
+		option(r.config)
+	}
+	err := r.check()
+	if err != nil {
+		readerPool.Put(r)
+		return dst, err
+	}
+	windowSize := 1 << r.window
+	if cap(r.windowBuffer) < windowSize {
+		r.windowBuffer = make([]byte, windowSize)
+	}
+	r.windowBuffer = r.windowBuffer[:windowSize]
+	r.Reset(nil)
+
+	dst, err = r.decodeAll(dst, src)
+
+	r.buffer = nil
+	readerPool.Put(r)
+	return dst, err
+}
+
+func (r *reader) decodeAll(dst, src []byte) ([]byte, error) {
+	r.buffer = src
+	r.inputSize = len(src)
+	var o output
+	for {
+		probing := r.maxOutput > 0 && r.limitedOutput() == r.maxOutput
+		if probing {
+			o.buf = r.probe[:]
+		} else {
+			if len(dst) == cap(dst) {
+				dst = append(dst, 0)[:len(dst)]
+			}
+			o.buf = r.limitOutput(dst[len(dst):cap(dst)])
+		}
+		o.size = len(o.buf)
+		outputSize, err := r.poll(&o)
+		if probing && outputSize > 0 {
+			r.err = ErrOutputLimitExceeded
+			return dst, r.err
+		}
+		dst = dst[:len(dst)+outputSize]
+		if err == errOutputBufferFull {
+			if r.finish() {
+				return dst, r.checkEnd()
+			}
+			continue
+		} else if err != nil {
+			return dst, err
+		}
+		if r.finish() {
+			return dst, r.checkEnd()
+		}
+		return dst, r.corrupt(ErrTruncated)
+	}
+}
+
+// CompressPrefix compresses as much of src as fits in dst, returning the number of bytes of src consumed and of dst
+// written. Compression stops at the first literal or back-reference which would overflow dst, and the stream is ended
+// before it, so decompressing dst[:written] gives exactly src[:consumed].
+//
+// options modifies the default configuration values to use when compressing. An error wrapping ErrConfig is returned if
+// any option value is invalid.
+func CompressPrefix(dst, src []byte, options ...func(*config)) (consumed int, written int, err error) {
+	p := &prefixWriter{buf: dst}
+	w, err := newWriter(p, options...)
+	if err != nil {
+		return 0, 0, err
+	}
+	w.prefix = p
+	_, err = w.Write(src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		return len(src), p.n, nil
+	} else if err != errOutputBufferFull {
+		return 0, 0, err
+	}
+
+	written = p.end
+	if p.partial {
+		dst[written] = p.last
+		written++
+	}
+	decoded, err := DecodeAll(nil, dst[:written], append(options[:len(options):len(options)], MaxOutput(0))...)
+	return len(decoded), written, err
+}
+
+// prefixWriter writes into buf for CompressPrefix, failing once it is full, and records where the last token which fits
+// starts: after end whole bytes, and the bits of last if partial.
+type prefixWriter struct {
+	buf []byte
+	n   int
+
+	end     int
+	last    byte
+	partial bool
+}
+
+// markToken records that a token starts after the whole bytes written so far and the bits of current before bitIndex,
+// unless those bits do not fit
+func (p *prefixWriter) markToken(current byte, bitIndex uint8) {
+	partial := bitIndex != 0x80
+	if partial && p.n == len(p.buf) {
+		return
+	}
+	p.end, p.last, p.partial = p.n, current, partial
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := copy(p.buf[p.n:], b)
+	p.n += n
+	if n < len(b) {
+		return n, errOutputBufferFull
+	}
+	return n, nil
+}
+
+func (p *prefixWriter) WriteByte(b byte) error {
+	if p.n == len(p.buf) {
+		return errOutputBufferFull
+	}
+	p.buf[p.n] = b
+	p.n++
+	return nil
+}
+
+func (p *prefixWriter) Flush() error {
+	return nil
+}
+
+// sliceWriter appends everything written to buf
+type sliceWriter struct {
+	buf []byte
+}
+
+func (s *sliceWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+func (s *sliceWriter) WriteByte(b byte) error {
+	s.buf = append(s.buf, b)
+	return nil
+}
+
+func (s *sliceWriter) Flush() error {
+	return nil
+}
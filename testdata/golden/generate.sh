@@ -0,0 +1,34 @@
+#!/bin/sh
+# Regenerates the golden vectors used by TestGoldenVectors with the C heatshrink reference implementation.
+#
+# Every file in inputs/ is compressed with every window from 4 to 15 and lookahead from 3 to window-1, writing
+# <input>.w<window>l<lookahead>, and each vector is decoded again to check it. The C sources are fetched unmodified at a
+# pinned release into c/ (or taken from $HEATSHRINK_SRC), and the upstream heatshrink command is built with their Makefile.
+set -e
+
+cd "$(dirname "$0")"
+
+version=0.4.1
+src=${HEATSHRINK_SRC:-c/heatshrink-$version}
+if [ ! -f "$src/heatshrink.c" ]; then
+	mkdir -p c
+	curl -fsSL "https://github.com/atomicobject/heatshrink/archive/refs/tags/v$version.tar.gz" | tar -xz -C c
+fi
+make -s -C "$src" heatshrink
+
+decoded=$(mktemp)
+trap 'rm -f "$decoded"' EXIT
+rm -f ./*.w*l*
+for input in inputs/*; do
+	name=$(basename "$input")
+	for window in 4 5 6 7 8 9 10 11 12 13 14 15; do
+		lookahead=3
+		while [ $lookahead -lt $window ]; do
+			vector="$name.w${window}l$lookahead"
+			"$src/heatshrink" -e -w $window -l $lookahead "$input" "$vector"
+			"$src/heatshrink" -d -w $window -l $lookahead "$vector" "$decoded"
+			cmp -s "$input" "$decoded" || { echo "$vector does not decode to $input" >&2; exit 1; }
+			lookahead=$((lookahead + 1))
+		done
+	done
+done
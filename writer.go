@@ -4,9 +4,25 @@ import (
 	"bufio"
 	"errors"
 	"io"
-	"log"
 )
 
+// WriteFlusher groups an io.WriteCloser with a Flush method, which forces all data written so far to the underlying io.Writer.
+type WriteFlusher interface {
+	io.WriteCloser
+	// Flush compresses any pending data and writes it to the underlying io.Writer, padded to a byte boundary,
+	// without ending the stream.
+	Flush() error
+}
+
+// WriteResetter groups a WriteFlusher with a Reset method, which can switch to a new underlying io.Writer.
+// This permits reusing a WriteFlusher instead of allocating a new one.
+type WriteResetter interface {
+	WriteFlusher
+	// Reset discards any buffered data and resets the WriteResetter as if it was
+	// newly initialized with the given writer.
+	Reset(w io.Writer)
+}
+
 type writer struct {
 	*config
 
@@ -22,10 +38,41 @@ type writer struct {
 	bitIndex          uint8
 
 	buffer    []byte
-	index     []int16
+	index     []int32
+	head      []int32
+	indexed   int
+	// Number of bytes at the end of the backlog which are earlier input or dictionary, rather than the initial zeros
+	history   int
+
+	lazyIndex    int
+	lazyPosition int
+	lazyLength   int
+
+	planStart    int
+	planEnd      int
+	planCost     []int
+	planLength   []int
+	planPosition []int
+
+	offline []byte
+
+	reference          []byte
+	referenceBuckets   []int32
+	referencePositions []int32
+	referenceCursor    int
+	referenceAddress   int
+	matchFromReference bool
 
 	inner       inner
+	buffered    *bufio.Writer
 	outputTotal int
+	err         error
+
+	// Set by CompressPrefix, to be told where each token starts
+	prefix *prefixWriter
+	// Set by estimators, which count the bits of output instead of producing them
+	counting    bool
+	countedBits int64
 }
 
 type inner interface {
@@ -38,6 +85,7 @@ type encodeFlags int
 const (
 	encodeFlagsNone      encodeFlags = 0
 	encodeFlagsFinishing             = 1
+	encodeFlagsFlushing              = 2
 )
 
 type encodeState int
@@ -52,6 +100,7 @@ const (
 	encodeStateYieldBackRefLength
 	encodeStateSaveBacklog
 	encodeStateFlushBits
+	encodeStateYieldSyncMarker
 	encodeStateDone
 	encodeStateInvalid
 )
@@ -59,32 +108,110 @@ const (
 const heatshrinkLiteralMarker byte = 0x01
 const heatshrinkBackrefMarker byte = 0x00
 
-// NewWriterConfig creates a new io.WriteCloser. Writes to the returned io.WriteCloser are compressed and written to w.
+// NewWriterConfig creates a new WriteResetter. Writes to the returned WriteResetter are compressed and written to w.
 //
 // config specifies the configuration values to use when compressing
 //
-// It is the caller's responsibility to call Close on the io.WriteCloser when done. Writes may be buffered and not flushed until Close.
-func NewWriter(w io.Writer, options ...func(*config)) io.WriteCloser {
+// It is the caller's responsibility to call Close on the WriteResetter when done. Writes may be buffered and not flushed until Flush or Close.
+//
+// Invalid option values are clamped to the nearest valid value. Use NewWriterOptions to have them reported instead.
+// The returned WriteResetter also implements Configurer, returning the settings used to compress.
+func NewWriter(w io.Writer, options ...func(*config)) WriteResetter {
+	hw, _ := newWriter(w, options...)
+	return hw
+}
+
+// NewWriterOptions is like NewWriter, but returns an error wrapping ErrConfig if any option value is invalid,
+// rather than compressing with different settings than requested. The returned WriteResetter also implements Configurer.
+func NewWriterOptions(w io.Writer, options ...func(*config)) (WriteResetter, error) {
+	hw, err := newWriter(w, options...)
+	if err != nil {
+		return nil, err
+	}
+	return hw, nil
+}
+
+func newWriter(w io.Writer, options ...func(*config)) (*writer, error) {
 	hw := &writer{
-		config: &config{window:defaultWindow, lookahead:defaultLookahead},
+		config: &config{window:defaultWindow, lookahead:defaultLookahead, level:defaultLevel},
 		state: encodeStateNotFull,
 		bitIndex: 0x80,
 	}
 	for _, option := range options {
 		option(hw.config)
 	}
-	bufSize := 2 << hw.window
-	bw, ok := w.(inner)
-	if !ok {
-		bw = bufio.NewWriter(w)
+	err := hw.check()
+	hw.setInner(w)
+	hw.allocate()
+	hw.resetIndex()
+	hw.loadDictionary(hw.buffer[:hw.getInputBufferSize()])
+	hw.history = len(hw.dictionaryWindow())
+	return hw, err
+}
+
+// Reset discards the state of the Writer w such that it is equivalent to its initial state, writing to new.
+// The buffers allocated for the previous stream are reused.
+func (w *writer) Reset(new io.Writer) {
+	for i := range w.buffer {
+		w.buffer[i] = 0
 	}
-	hw.inner = bw
-	hw.buffer = make([]byte, bufSize)
-	hw.index = make([]int16, bufSize)
-	return hw
+	w.loadDictionary(w.buffer[:w.getInputBufferSize()])
+	w.history = len(w.dictionaryWindow())
+	w.inputSize = 0
+	w.matchScanIndex = 0
+	w.matchLength = 0
+	w.matchPosition = 0
+	w.outgoingBits = 0
+	w.outgoingBitsCount = 0
+	w.flags = encodeFlagsNone
+	w.state = encodeStateNotFull
+	w.current = 0x0
+	w.bitIndex = 0x80
+	w.outputTotal = 0
+	w.countedBits = 0
+	w.err = nil
+	w.offline = w.offline[:0]
+	w.referenceCursor = 0
+	w.resetIndex()
+	w.setInner(new)
+}
+
+// allocate sizes the buffers for the configured window, reusing the existing allocations if they are big enough
+func (w *writer) allocate() {
+	bufSize := 2 << w.window
+	if cap(w.buffer) < bufSize {
+		w.buffer = make([]byte, bufSize)
+		w.index = make([]int32, bufSize)
+	}
+	w.buffer = w.buffer[:bufSize]
+	w.index = w.index[:bufSize]
+	hashSize := 1 << hashBits(w.window)
+	if cap(w.head) < hashSize {
+		w.head = make([]int32, hashSize)
+	}
+	w.head = w.head[:hashSize]
+}
+
+func (w *writer) setInner(new io.Writer) {
+	if bw, ok := new.(inner); ok {
+		w.inner = bw
+		return
+	}
+	if w.buffered == nil {
+		w.buffered = bufio.NewWriter(new)
+	} else {
+		w.buffered.Reset(new)
+	}
+	w.inner = w.buffered
 }
 
 func (w *writer) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.level == OfflineLevel {
+		return w.bufferOffline(p)
+	}
 	var done int
 	total := len(p)
 	for {
@@ -120,7 +247,17 @@ func (w *writer) Write(p []byte) (n int, err error) {
 }
 
 func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
 	var err error
+	if w.level == OfflineLevel && !w.isFinishing() {
+		err = w.encodeOffline()
+		if err != nil {
+			w.err = err
+			return err
+		}
+	}
 	if w.finish() {
 		err = w.inner.Flush()
 		if err != nil {
@@ -142,6 +279,38 @@ func (w *writer) Close() error {
 	return ErrBadStateOnClose
 }
 
+// Flush compresses all pending input and writes it to the underlying writer, so that a reader receiving the output so far
+// can decompress everything written before the Flush. The sliding window is kept, so later data can still back-reference
+// data written before the Flush.
+//
+// If the output does not end on a byte boundary, Flush first writes a sync marker (a back-reference of length 1, which is
+// never produced otherwise) telling the reader to skip to the next byte. Streams containing sync markers can only be
+// decompressed by this package's reader.
+func (w *writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.isFinishing() {
+		return nil
+	}
+	if w.level == OfflineLevel {
+		err := w.encodeOffline()
+		if err != nil {
+			w.err = err
+			return err
+		}
+	}
+	w.flags |= encodeFlagsFlushing
+	if w.state == encodeStateNotFull {
+		w.state = encodeStateFilled
+	}
+	_, err := w.poll()
+	if err != nil {
+		return err
+	}
+	return w.inner.Flush()
+}
+
 func (w *writer) sink(in []byte) (int, error) {
 	if w.isFinishing() {
 		return 0, errors.New("sinking while finishing")
@@ -169,6 +338,9 @@ func (w *writer) sink(in []byte) (int, error) {
 func (w *writer) poll() (int, error) {
 
 	w.outputTotal = 0
+	if w.err != nil {
+		return 0, w.err
+	}
 	var err error
 
 	for {
@@ -193,14 +365,16 @@ func (w *writer) poll() (int, error) {
 			w.state = w.stateSaveBacklog()
 		case encodeStateFlushBits:
 			w.state, err = w.stateFlushBitBuffer()
+		case encodeStateYieldSyncMarker:
+			w.state, err = w.stateYieldSyncMarker()
 		case encodeStateDone:
 			return w.outputTotal, nil
-		case encodeStateInvalid:
-			log.Fatal("Invalid state: %v", state)
 		default:
-			log.Fatal("Unknown state: %v", state)
+			err = &StateError{Machine: "writer", State: int(state)}
 		}
 		if err != nil {
+			// A state which failed part way cannot be resumed
+			w.err = err
 			return w.outputTotal, err
 		}
 
@@ -217,30 +391,27 @@ func (w *writer) finish() bool {
 }
 
 func (w *writer) stateStepSearch() encodeState {
-	windowLength := 1 << w.window
-	lookaheadLength := 1 << w.lookahead
 	msi := w.matchScanIndex
-	fin := w.isFinishing()
-	var lookaheadCompare int
-	if fin {
-		lookaheadCompare = 1
-	} else {
-		lookaheadCompare = lookaheadLength
-	}
-	if msi > w.inputSize-lookaheadCompare {
-		if fin {
+	if msi > w.lastSearchIndex() {
+		if w.isFinishing() {
 			return encodeStateFlushBits
 		}
+		if w.isFlushing() {
+			return encodeStateYieldSyncMarker
+		}
 		return encodeStateSaveBacklog
 	}
-	ibs := w.getInputBufferSize()
-	end := ibs + msi
-	start := end - windowLength
-	maxPossible := lookaheadLength
-	if w.inputSize-msi < lookaheadLength {
-		maxPossible = w.inputSize - msi
+	var matchPos, matchLength int
+	switch {
+	case w.reference != nil:
+		matchPos, matchLength = w.deltaMatch(msi)
+	case w.level == LazyLevel:
+		matchPos, matchLength = w.lazyMatch(msi)
+	case w.level == OptimalLevel:
+		matchPos, matchLength = w.plannedMatch(msi)
+	default:
+		matchPos, matchLength = w.longestMatchAt(msi)
 	}
-	matchPos, matchLength := w.findLongestMatch(start, end, maxPossible)
 	if matchPos == matchNotFound {
 		w.matchScanIndex++
 		w.matchLength = 0
@@ -253,6 +424,40 @@ func (w *writer) stateStepSearch() encodeState {
 	return encodeStateYieldTagBit
 }
 
+// lastSearchIndex returns the last matchScanIndex that can be searched before more input is needed
+func (w *writer) lastSearchIndex() int {
+	if w.isFinishing() || w.isFlushing() {
+		return w.inputSize - 1
+	}
+	return w.inputSize - w.maxMatchLength()
+}
+
+// maxMatchLength returns the longest back-reference to search for. A lookahead not less than the window, as allowed by
+// NewWriter, is limited to the input buffer.
+func (w *writer) maxMatchLength() int {
+	if w.lookahead >= w.window {
+		return w.getInputBufferSize()
+	}
+	return 1 << w.lookahead
+}
+
+// longestMatchAt returns the offset and length of the longest match for the input at msi
+func (w *writer) longestMatchAt(msi int) (int, int) {
+	windowLength := 1 << w.window
+	lookaheadLength := w.maxMatchLength()
+	ibs := w.getInputBufferSize()
+	end := ibs + msi
+	start := end - windowLength
+	if w.strict && start < ibs-w.history {
+		start = ibs - w.history
+	}
+	maxPossible := lookaheadLength
+	if w.inputSize-msi < lookaheadLength {
+		maxPossible = w.inputSize - msi
+	}
+	return w.findLongestMatch(start, end, maxPossible)
+}
+
 func (w *writer) stateYieldTagBit() (encodeState, error) {
 	if w.matchLength == 0 {
 		err := w.addTagBit(heatshrinkLiteralMarker)
@@ -265,6 +470,21 @@ func (w *writer) stateYieldTagBit() (encodeState, error) {
 	if err != nil {
 		return encodeStateInvalid, err
 	}
+	if w.reference != nil {
+		var source byte
+		if w.matchFromReference {
+			source = 1
+		}
+		err = w.pushBits(1, source)
+		if err != nil {
+			return encodeStateInvalid, err
+		}
+		if w.matchFromReference {
+			w.outgoingBits = w.matchPosition
+			w.outgoingBitsCount = deltaOffsetBits
+			return encodeStateYieldBackRefIndex, nil
+		}
+	}
 	w.outgoingBits = w.matchPosition - 1
 	w.outgoingBitsCount = w.window
 	return encodeStateYieldBackRefIndex, nil
@@ -299,6 +519,10 @@ func (w *writer) stateYieldBackRefLength() (encodeState, error) {
 	if count > 0 {
 		return encodeStateYieldBackRefLength, nil
 	}
+	if w.matchFromReference {
+		w.referenceCursor = w.referenceAddress + w.matchLength
+		w.matchFromReference = false
+	}
 	w.matchScanIndex += w.matchLength
 	w.matchLength = 0
 	return encodeStateSearch, nil
@@ -321,6 +545,41 @@ func (w *writer) stateFlushBitBuffer() (encodeState, error) {
 	return encodeStateDone, nil
 }
 
+func (w *writer) stateYieldSyncMarker() (encodeState, error) {
+	if w.bitIndex != 0x80 {
+		err := w.addTagBit(heatshrinkBackrefMarker)
+		if err != nil {
+			return encodeStateInvalid, err
+		}
+		// Index and length fields of zero (offset 1, length 1), then zero padding up to the byte boundary.
+		// Delta streams also have a zero source bit, selecting the window.
+		count := w.window + w.lookahead
+		if w.reference != nil {
+			count++
+		}
+		for count > 0 {
+			n := count
+			if n > 8 {
+				n = 8
+			}
+			err = w.pushBits(n, 0)
+			if err != nil {
+				return encodeStateInvalid, err
+			}
+			count -= n
+		}
+		for w.bitIndex != 0x80 {
+			err = w.pushBits(1, 0)
+			if err != nil {
+				return encodeStateInvalid, err
+			}
+		}
+	}
+	w.flags &^= encodeFlagsFlushing
+	w.saveBacklog()
+	return encodeStateNotFull, nil
+}
+
 const matchNotFound = ^int(0)
 
 func (w *writer) findLongestMatch(start int, end int, max int) (int, int) {
@@ -328,28 +587,34 @@ func (w *writer) findLongestMatch(start int, end int, max int) (int, int) {
 	var matchIndex = matchNotFound
 	var len int
 	needlepoint := w.buffer[end:]
-	pos := w.index[end]
+	pos := matchNotFound
+	if end < w.indexed {
+		pos = int(w.index[end])
+	}
+	chain := 0
 
-	for pos-int16(start) >= 0 {
+	for ; pos >= start; pos = int(w.index[pos]) {
+		if w.maxChainLength > 0 && chain == w.maxChainLength {
+			break
+		}
+		chain++
 		pospoint := w.buffer[pos:]
-		len = 0
 		if pospoint[matchMaxLength] != needlepoint[matchMaxLength] {
-			pos = w.index[pos]
 			continue
 		}
-		for len = 1; len < max; len++ {
+		// Positions are chained by a hash of their first two bytes, which may collide
+		for len = 0; len < max; len++ {
 			if pospoint[len] != needlepoint[len] {
 				break
 			}
 		}
 		if len > matchMaxLength {
 			matchMaxLength = len
-			matchIndex = int(pos)
+			matchIndex = pos
 			if len == max {
 				break
 			}
 		}
-		pos = w.index[pos]
 	}
 	breakEven := 1 + w.window + w.lookahead
 	if 8*uint(matchMaxLength) > uint(breakEven) {
@@ -367,6 +632,10 @@ func (w *writer) pushLiteralByte() error {
 }
 
 func (w *writer) pushBits(count uint8, bits byte) error {
+	if w.counting {
+		w.countedBits += int64(count)
+		return nil
+	}
 	if count == 8 && w.bitIndex == 0x80 {
 		err := w.inner.WriteByte(bits)
 		if err == nil {
@@ -415,7 +684,22 @@ func (w *writer) pushOutgoingBits() (uint8, error) {
 	return count, nil
 }
 
+// pushWideBits pushes the low count bits of bits, which may be more than 8
+func (w *writer) pushWideBits(count uint8, bits int) error {
+	for count > 8 {
+		count -= 8
+		err := w.pushBits(8, byte(bits>>count))
+		if err != nil {
+			return err
+		}
+	}
+	return w.pushBits(count, byte(bits))
+}
+
 func (w *writer) addTagBit(tag byte) error {
+	if w.prefix != nil {
+		w.prefix.markToken(w.current, w.bitIndex)
+	}
 	return w.pushBits(1, tag)
 }
 
@@ -424,28 +708,84 @@ func (w *writer) saveBacklog() {
 	copy(w.buffer, w.buffer[msi:])
 	w.matchScanIndex = 0
 	w.inputSize -= msi
+	w.history += msi
+	if ibs := w.getInputBufferSize(); w.history > ibs {
+		w.history = ibs
+	}
+	w.invalidateParse()
+	w.rebaseIndex(msi)
 }
 
 func (w *writer) getInputBufferSize() int {
 	return 1 << w.window
 }
 
+// doIndexing adds each position in the buffer which has a following byte to the chain of earlier positions with the same
+// hash of their first two bytes. Positions indexed before the last saveBacklog are kept, so only new input is hashed.
 func (w *writer) doIndexing() {
-	var last [256]int16
-	for i := range last {
-		last[i] = -1
-	}
+	w.invalidateParse()
 	ibs := w.getInputBufferSize()
-	end := ibs + w.inputSize
-	var i int
-	for i = 0; i < end; i++ {
-		v := w.buffer[i]
-		lv := last[v]
-		w.index[i] = lv
-		last[v] = int16(i)
+	end := ibs + w.inputSize - 1
+	bits := hashBits(w.window)
+	for i := w.indexed; i < end; i++ {
+		h := hash2(w.buffer[i], w.buffer[i+1], bits)
+		w.index[i] = w.head[h]
+		w.head[h] = int32(i)
+	}
+	if end > w.indexed {
+		w.indexed = end
+	}
+}
+
+// rebaseIndex moves the index along with the buffer when saveBacklog discards the first shift positions
+func (w *writer) rebaseIndex(shift int) {
+	w.indexed -= shift
+	if w.indexed < 0 {
+		w.indexed = 0
+	}
+	copy(w.index, w.index[shift:shift+w.indexed])
+	for i := 0; i < w.indexed; i++ {
+		w.index[i] = rebase(w.index[i], shift)
+	}
+	for i := range w.head {
+		w.head[i] = rebase(w.head[i], shift)
 	}
 }
 
+func (w *writer) resetIndex() {
+	for i := range w.head {
+		w.head[i] = -1
+	}
+	w.indexed = 0
+}
+
+func rebase(pos int32, shift int) int32 {
+	pos -= int32(shift)
+	if pos < 0 {
+		return -1
+	}
+	return pos
+}
+
+// hashBits returns the size of the hash table for a window, big enough that collisions are rare.
+func hashBits(window uint8) uint8 {
+	bits := window + 1
+	if bits < 8 {
+		return 8
+	} else if bits > 16 {
+		return 16
+	}
+	return bits
+}
+
+func hash2(a byte, b byte, bits uint8) int {
+	return int((uint32(a)<<8 | uint32(b)) * 2654435761 >> (32 - bits))
+}
+
 func (w *writer) isFinishing() bool {
 	return w.flags&encodeFlagsFinishing == encodeFlagsFinishing
 }
+
+func (w *writer) isFlushing() bool {
+	return w.flags&encodeFlagsFlushing == encodeFlagsFlushing
+}